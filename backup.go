@@ -0,0 +1,418 @@
+package flop
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// numberedBackupFile matches files that looks like file.ext.~1~ and uses a capture group to grab the number
+var numberedBackupFile = regexp.MustCompile(`^.*\.~([0-9]{1,5})~$`)
+
+// Retention limits which numbered and timestamped backups are kept after a successful copy.  A zero value
+// keeps every backup.
+type Retention struct {
+	// Count keeps only the newest Count backups when greater than zero.
+	Count int
+	// MaxAge removes backups older than MaxAge when greater than zero.  A timestamped backup is as old as the
+	// time in its name, a numbered backup as its modification time, which for a hard linked backup is that of
+	// the file it replaced.  The newest backup, usually the one just made, is never removed for its age.
+	MaxAge time.Duration
+}
+
+// isSet returns true if the Retention will prune any backups.
+func (r Retention) isSet() bool {
+	return r.Count > 0 || r.MaxAge > 0
+}
+
+// defaultBackupTimeLayout is used to name timestamped backups when Options.BackupTimeLayout is empty.
+const defaultBackupTimeLayout = "20060102T150405Z"
+
+// backupFileVersion matches files that look like file.ext.~version~ and uses a capture group to grab the
+// version, which is either a number or a timestamp.
+var backupFileVersion = regexp.MustCompile(`^.*\.~([^~]+)~$`)
+
+// Backup describes a backup file made by Copy.
+type Backup struct {
+	// Path is the path of the backup file.
+	Path string
+	// Number is the number of a numbered backup, 0 otherwise.
+	Number int
+	// Time is the time a timestamped backup was made, zero otherwise.
+	Time time.Time
+	// seq orders timestamped backups made within the same resolution of the time layout, see timestampedPath.
+	seq int
+}
+
+// backupBase returns the path backups of file are named after.  Without Options.BackupDir this is the file
+// itself, otherwise it is the file's path relative to the destination root, mirrored under BackupDir.
+func (o *Options) backupBase(file string) string {
+	if o.BackupDir == "" {
+		return file
+	}
+	rel, err := filepath.Rel(o.dstRoot, file)
+	if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+		rel = filepath.Base(file)
+	}
+	return filepath.Join(o.BackupDir, rel)
+}
+
+// versionedBackups returns the numbered and timestamped backups of base.  Numbered backups are sorted by
+// number and come before timestamped backups, which are sorted by time, so the newest backup is last.
+func versionedBackups(base, layout string) ([]Backup, error) {
+	// find general matches that look like versioned backup files
+	m, err := filepath.Glob(base + ".~*~")
+	if err != nil {
+		return nil, err
+	}
+
+	var backups []Backup
+	for _, f := range m {
+		subs := backupFileVersion.FindStringSubmatch(filepath.Base(f))
+		if len(subs) <= 1 || f != fmt.Sprintf("%s.~%s~", base, subs[1]) {
+			continue
+		}
+		if numberedBackupFile.MatchString(f) {
+			i, _ := strconv.Atoi(subs[1])
+			backups = append(backups, Backup{Path: f, Number: i})
+		} else if t, seq, ok := parseTimestamp(layout, subs[1]); ok {
+			backups = append(backups, Backup{Path: f, Time: t, seq: seq})
+		}
+	}
+	sort.Slice(backups, func(i, j int) bool {
+		if backups[i].Time.IsZero() != backups[j].Time.IsZero() {
+			return backups[i].Time.IsZero()
+		}
+		if backups[i].Time.IsZero() {
+			return backups[i].Number < backups[j].Number
+		}
+		if backups[i].Time.Equal(backups[j].Time) {
+			return backups[i].seq < backups[j].seq
+		}
+		return backups[i].Time.Before(backups[j].Time)
+	})
+	return backups, nil
+}
+
+// parseTimestamp parses the version of a timestamped backup, which is the time in layout optionally followed by
+// "-" and a sequence number, see timestampedPath.
+func parseTimestamp(layout, version string) (time.Time, int, bool) {
+	if t, err := time.Parse(layout, version); err == nil {
+		return t, 0, true
+	}
+	i := strings.LastIndex(version, "-")
+	if i < 0 {
+		return time.Time{}, 0, false
+	}
+	seq, err := strconv.Atoi(version[i+1:])
+	if err != nil || seq < 1 {
+		return time.Time{}, 0, false
+	}
+	t, err := time.Parse(layout, version[:i])
+	return t, seq, err == nil
+}
+
+// timestampedPath returns the path of a timestamped backup of base made now.  A backup already made within the
+// same resolution of the layout is never replaced, a sequence number is added instead, like
+// file.~20060102T150405Z-1~.
+func timestampedPath(base, layout string) string {
+	stamp := time.Now().UTC().Format(layout)
+	bkp := fmt.Sprintf("%s.~%s~", base, stamp)
+	for seq := 1; ; seq++ {
+		if _, err := os.Lstat(bkp); os.IsNotExist(err) {
+			return bkp
+		}
+		bkp = fmt.Sprintf("%s.~%s-%d~", base, stamp, seq)
+	}
+}
+
+// backupPath returns the path of the next backup of file for the chosen control method, or an empty string
+// if no backup should be made.  See Options.Backup.
+func backupPath(file *File, control string, opts Options) (string, error) {
+	base := opts.backupBase(file.Path)
+	layout := opts.backupTimeLayout()
+	backups, err := versionedBackups(base, layout)
+	if err != nil {
+		return "", err
+	}
+
+	// next gives the next unused backup file number, 1 above the current highest
+	next := func() int {
+		var highest int
+		for _, bkp := range backups {
+			if bkp.Number > highest {
+				highest = bkp.Number
+			}
+		}
+		return highest + 1
+	}
+
+	simple := base + opts.backupSuffix()
+	numbered := func(n int) string {
+		return fmt.Sprintf("%s.~%d~", base, n)
+	}
+	timestamped := func() string {
+		return timestampedPath(base, layout)
+	}
+
+	switch control {
+	default:
+		return "", &Error{Op: "backup", Dst: file.Path, Kind: ErrInvalidBackupControlValue, Err: errors.Errorf("backup value '%s'", control)}
+	case "off", "none":
+		return "", nil
+	case "simple", "never":
+		return simple, nil
+	case "numbered", "t":
+		return numbered(next()), nil
+	case "timestamp":
+		return timestamped(), nil
+	case "existing", "nil":
+		if i := next(); i > 1 {
+			return numbered(i), nil
+		}
+		if len(backups) > 0 {
+			return timestamped(), nil
+		}
+		return simple, nil
+	}
+}
+
+// backupOptions returns the Options used to copy a backup.  The backup itself is a plain copy, never back up
+// the backup.  An older backup of the same name is always replaced, so the conflict options are not used.
+// The copy is reported with Hooks.OnBackup, not as a copy.
+func (o Options) backupOptions() Options {
+	bkpOpts := o
+	bkpOpts.Backup, bkpOpts.BackupEnv, bkpOpts.BackupRetain = "", false, Retention{}
+	bkpOpts.Atomic = false
+	bkpOpts.NoClobber, bkpOpts.OnConflict, bkpOpts.Resume = false, nil, false
+	bkpOpts.Hooks = Hooks{OnMkdir: o.Hooks.OnMkdir}
+	if o.BackupDir != "" {
+		bkpOpts.mkdirAll = true
+	}
+	return bkpOpts
+}
+
+// backupFile will create a backup of the file using the chosen control method.  See Options.Backup.
+func backupFile(file *File, control string, opts Options) error {
+	// TODO: this func could be more efficient if it used file instead of the path but right now this causes panic
+	// do not copy if the file did not exist
+	if !file.existOnInit {
+		return nil
+	}
+
+	bkp, err := backupPath(file, control, opts)
+	if err != nil || bkp == "" {
+		return err
+	}
+	opts.logDebug("creating backup file", "backup", bkp)
+	if err := Copy(file.Path, bkp, opts.backupOptions()); err != nil {
+		return err
+	}
+	opts.Hooks.onBackup(file.Path, bkp)
+	return nil
+}
+
+// linkBackup creates a backup of the file by hard linking it into place, falling back to a copy when the
+// backup cannot be linked, like when Options.BackupDir is on another device.  The backup is staged under a
+// temporary name and renamed into place so an older backup with the same name is only replaced once the
+// new one is complete.  rollback removes the new backup and puts any replaced backup back, commit discards
+// the replaced backup.  Both are safe to call when no backup was made.
+func linkBackup(file *File, control string, opts Options) (commit, rollback func(), err error) {
+	noop := func() {}
+	if !file.existOnInit || control == "" {
+		return noop, noop, nil
+	}
+	bkp, err := backupPath(file, control, opts)
+	if err != nil || bkp == "" {
+		return noop, noop, err
+	}
+	if opts.BackupDir != "" {
+		if err := mkdirAll(filepath.Dir(bkp), 0777, opts); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	// stage the new backup next to its final name
+	if err := confineDir(filepath.Dir(bkp), opts); err != nil {
+		return nil, nil, err
+	}
+	opts.logDebug("creating backup file by hard link", "backup", bkp)
+	staged, err := linkTemp(file.Path, bkp)
+	if err != nil {
+		opts.logDebug("cannot hard link backup file, copying instead", "backup", bkp, "err", err)
+		staged = unusedTemp(bkp)
+		if err := Copy(file.Path, staged, opts.backupOptions()); err != nil {
+			_ = os.Remove(staged)
+			return nil, nil, err
+		}
+	}
+
+	// keep a link to any backup about to be replaced so it can be restored
+	var replaced string
+	if _, err := os.Lstat(bkp); err == nil {
+		if replaced, err = linkTemp(bkp, bkp); err != nil {
+			_ = os.Remove(staged)
+			return nil, nil, err
+		}
+	}
+
+	if err := opts.Journal.record(bkp, true, opts); err != nil {
+		_ = os.Remove(staged)
+		if replaced != "" {
+			_ = os.Remove(replaced)
+		}
+		return nil, nil, err
+	}
+	if err := os.Rename(staged, bkp); err != nil {
+		_ = os.Remove(staged)
+		if replaced != "" {
+			_ = os.Remove(replaced)
+		}
+		return nil, nil, err
+	}
+
+	commit = func() {
+		if replaced != "" {
+			if err := os.Remove(replaced); err != nil {
+				opts.logDebug("err removing replaced backup file", "backup", replaced, "err", err)
+			}
+		}
+	}
+	rollback = func() {
+		opts.logDebug("rolling back backup file", "backup", bkp)
+		if replaced != "" {
+			if err := os.Rename(replaced, bkp); err != nil {
+				opts.logDebug("err restoring replaced backup file", "backup", bkp, "err", err)
+			}
+			return
+		}
+		if err := os.Remove(bkp); err != nil {
+			opts.logDebug("err removing backup file", "backup", bkp, "err", err)
+		}
+	}
+	if err := syncParent(bkp, opts); err != nil {
+		rollback()
+		return nil, nil, err
+	}
+	opts.Hooks.onBackup(file.Path, bkp)
+	return commit, rollback, nil
+}
+
+// linkTemp hard links oldname to an unused temporary name next to newname and returns the temporary name.
+func linkTemp(oldname, newname string) (string, error) {
+	for {
+		tmp := unusedTemp(newname)
+		err := os.Link(oldname, tmp)
+		if err == nil {
+			return tmp, nil
+		}
+		if !os.IsExist(err) {
+			return "", err
+		}
+	}
+}
+
+// makesBackup returns false for the control values that turn backups off.
+func makesBackup(control string) bool {
+	switch control {
+	case "", "off", "none":
+		return false
+	}
+	return true
+}
+
+// unusedTemp returns a temporary name next to path that does not exist yet.
+func unusedTemp(path string) string {
+	for i := 0; ; i++ {
+		tmp := fmt.Sprintf("%s.tmp-%d-%d", path, os.Getpid(), i)
+		if _, err := os.Lstat(tmp); os.IsNotExist(err) {
+			return tmp
+		}
+	}
+}
+
+// pruneBackups removes numbered and timestamped backups of file that fall outside Options.BackupRetain.  It
+// only prunes when the copy makes numbered or timestamped backups, so turning backups off, or making simple
+// ones, never removes existing backups.
+func pruneBackups(file *File, opts Options) error {
+	if !opts.BackupRetain.isSet() {
+		return nil
+	}
+	switch control := opts.backupControl(); {
+	case !makesBackup(control), control == "simple", control == "never":
+		return nil
+	}
+
+	backups, err := versionedBackups(opts.backupBase(file.Path), opts.backupTimeLayout())
+	if err != nil {
+		return err
+	}
+	for i, bkp := range backups {
+		remove := opts.BackupRetain.Count > 0 && i < len(backups)-opts.BackupRetain.Count
+		if !remove && opts.BackupRetain.MaxAge > 0 && i < len(backups)-1 {
+			made := bkp.Time
+			if made.IsZero() {
+				info, err := os.Stat(bkp.Path)
+				if err != nil {
+					return err
+				}
+				made = info.ModTime()
+			}
+			remove = time.Since(made) > opts.BackupRetain.MaxAge
+		}
+		if remove {
+			opts.logDebug("removing backup file outside of retention", "backup", bkp.Path)
+			if err := opts.Journal.record(bkp.Path, true, opts); err != nil {
+				return err
+			}
+			if err := os.Remove(bkp.Path); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// ListBackups returns the simple, numbered and timestamped backups of path, using the backup suffix, time
+// layout and backup directory from opts like Copy does when path is its destination.  The simple backup
+// comes first, then numbered backups sorted by number and timestamped backups sorted by time, so the
+// newest numbered or timestamped backup is last.
+func ListBackups(path string, opts Options) ([]Backup, error) {
+	opts.dstRoot = path
+	base := opts.backupBase(path)
+
+	var backups []Backup
+	simple := base + opts.backupSuffix()
+	if info, err := os.Lstat(simple); err == nil && !info.IsDir() {
+		backups = append(backups, Backup{Path: simple})
+	}
+
+	versioned, err := versionedBackups(base, opts.backupTimeLayout())
+	if err != nil {
+		return nil, err
+	}
+	return append(backups, versioned...), nil
+}
+
+// RestoreBackup atomically replaces path with the content of which, usually one of the backups returned by
+// ListBackups.  If opts has a backup control value the current file is backed up first, so a restore can
+// itself be undone.
+func RestoreBackup(path string, which Backup, opts Options) error {
+	opts.setLoggers()
+	if _, err := os.Lstat(which.Path); err != nil {
+		return &Error{Op: "restore", Src: which.Path, Dst: path, Kind: ErrFileNotExist}
+	}
+
+	opts.logInfo("restoring backup", "backup", which.Path, "dst", path)
+	opts.Atomic = true
+	opts.NoClobber, opts.Link, opts.Parents, opts.AppendNameToPath = false, false, false, false
+	opts.dstRoot = path
+	return Copy(which.Path, path, opts)
+}
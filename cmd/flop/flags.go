@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// argKind describes whether a flag takes a value.
+type argKind int
+
+const (
+	// noArg flags never take a value.
+	noArg argKind = iota
+	// requiredArg flags take a value as the next argument or after '=' when long.
+	requiredArg
+	// optionalArg flags only take a value when given in the form --flag=value.
+	optionalArg
+)
+
+// flagSpec describes a single GNU-style command line flag.
+type flagSpec struct {
+	// short is the single character form, like 'r' for -r.  Zero if there is no short form.
+	short byte
+	// long is the long form without leading dashes, like "recursive" for --recursive.
+	long string
+	// arg determines if the flag takes a value.
+	arg argKind
+	// argName names the value in usage output.
+	argName string
+	// usage is a short description of the flag.
+	usage string
+	// set applies the flag.  value is empty for flags given without a value.
+	set func(value string) error
+}
+
+// parseFlags parses GNU-style flags from args and returns the remaining operands.  Short flags may be
+// combined as in -rnv, long flags may be abbreviated to any unambiguous prefix, and "--" ends flag parsing.
+func parseFlags(specs []flagSpec, args []string) ([]string, error) {
+	var operands []string
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "--":
+			return append(operands, args[i+1:]...), nil
+		case strings.HasPrefix(arg, "--"):
+			name, value, hasValue := arg[2:], "", false
+			if eq := strings.Index(name, "="); eq >= 0 {
+				name, value, hasValue = name[:eq], name[eq+1:], true
+			}
+			spec, err := lookupLong(specs, name)
+			if err != nil {
+				return nil, err
+			}
+			switch spec.arg {
+			case noArg:
+				if hasValue {
+					return nil, fmt.Errorf("option '--%s' doesn't allow an argument", spec.long)
+				}
+			case requiredArg:
+				if !hasValue {
+					if i+1 >= len(args) {
+						return nil, fmt.Errorf("option '--%s' requires an argument", spec.long)
+					}
+					i++
+					value = args[i]
+				}
+			}
+			if err := spec.set(value); err != nil {
+				return nil, err
+			}
+		case strings.HasPrefix(arg, "-") && arg != "-":
+			for j := 1; j < len(arg); j++ {
+				spec, err := lookupShort(specs, arg[j])
+				if err != nil {
+					return nil, err
+				}
+				var value string
+				if spec.arg == requiredArg {
+					// the value is either the rest of this argument or the next argument
+					if j+1 < len(arg) {
+						value = arg[j+1:]
+					} else if i+1 < len(args) {
+						i++
+						value = args[i]
+					} else {
+						return nil, fmt.Errorf("option requires an argument -- '%c'", arg[j])
+					}
+					j = len(arg)
+				}
+				if err := spec.set(value); err != nil {
+					return nil, err
+				}
+			}
+		default:
+			operands = append(operands, arg)
+		}
+	}
+	return operands, nil
+}
+
+// lookupLong finds the flag named name or uniquely abbreviated by it.
+func lookupLong(specs []flagSpec, name string) (*flagSpec, error) {
+	var match *flagSpec
+	for i := range specs {
+		if specs[i].long == "" || !strings.HasPrefix(specs[i].long, name) {
+			continue
+		}
+		if specs[i].long == name {
+			return &specs[i], nil
+		}
+		if match != nil {
+			return nil, fmt.Errorf("option '--%s' is ambiguous", name)
+		}
+		match = &specs[i]
+	}
+	if match == nil {
+		return nil, fmt.Errorf("unrecognized option '--%s'", name)
+	}
+	return match, nil
+}
+
+// lookupShort finds the flag with the short form c.
+func lookupShort(specs []flagSpec, c byte) (*flagSpec, error) {
+	for i := range specs {
+		if specs[i].short == c {
+			return &specs[i], nil
+		}
+	}
+	return nil, fmt.Errorf("invalid option -- '%c'", c)
+}
+
+// usage formats the flag descriptions for help output.
+func usage(specs []flagSpec) string {
+	var b strings.Builder
+	for _, spec := range specs {
+		var names string
+		if spec.short != 0 {
+			names = fmt.Sprintf("-%c", spec.short)
+			if spec.long != "" {
+				names += ", "
+			}
+		} else {
+			names = "    "
+		}
+		if spec.long != "" {
+			names += "--" + spec.long
+		}
+		switch spec.arg {
+		case requiredArg:
+			names += "=" + spec.argName
+		case optionalArg:
+			names += "[=" + spec.argName + "]"
+		}
+		fmt.Fprintf(&b, "  %-28s %s\n", names, spec.usage)
+	}
+	return b.String()
+}
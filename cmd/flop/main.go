@@ -0,0 +1,286 @@
+// Command flop copies files and directories using the flop library.  It accepts the same invocation as
+// GNU cp for the options flop supports:
+//
+//	flop [OPTION]... [-T] SOURCE DEST
+//	flop [OPTION]... SOURCE... DIRECTORY
+//	flop [OPTION]... -t DIRECTORY SOURCE...
+//
+// Paths in the form s3://bucket/prefix refer to an S3-compatible bucket.  Credentials are read from the
+// AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY, AWS_SESSION_TOKEN and AWS_REGION environment variables and the
+// endpoint from --s3-endpoint or AWS_ENDPOINT_URL.
+package main
+
+import (
+	stderrors "errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/homedepot/flop"
+	"github.com/homedepot/flop/s3"
+)
+
+// Exit codes.  Any failure not listed below exits with exitFailure.
+const (
+	// exitOK means every source was copied.
+	exitOK = 0
+	// exitFailure means a copy failed for a reason without a more specific code.
+	exitFailure = 1
+	// exitUsage means the command line or an option value was invalid.
+	exitUsage = 2
+	// exitNotExist means a source did not exist.
+	exitNotExist = 3
+	// exitCannotRead means a source could not be stat'ed, opened or read.
+	exitCannotRead = 4
+	// exitCannotWrite means a destination could not be created, written, renamed or chmod'ed.
+	exitCannotWrite = 5
+	// exitTypeConflict means a file and directory were mixed in a way that cannot be copied.
+	exitTypeConflict = 6
+)
+
+// exitCodes maps flop's sentinel errors to exit codes.
+var exitCodes = map[error]int{
+	flop.ErrInvalidBackupControlValue: exitUsage,
+	flop.ErrUnknownBucket:             exitUsage,
+	flop.ErrObjectToObject:            exitUsage,
+	flop.ErrMissingSrc:                exitUsage,
+	flop.ErrTooManySrcs:               exitUsage,
+	flop.ErrTargetDirectoryConflict:   exitUsage,
+	flop.ErrFileNotExist:              exitNotExist,
+	flop.ErrCannotOpenSrc:             exitCannotRead,
+	flop.ErrCannotStatFile:            exitCannotRead,
+	flop.ErrReadingSrcDir:             exitCannotRead,
+	flop.ErrCannotOpenOrCreateDstFile: exitCannotWrite,
+	flop.ErrCannotCreateTmpFile:       exitCannotWrite,
+	flop.ErrCannotRenameTempFile:      exitCannotWrite,
+	flop.ErrCannotChmodFile:           exitCannotWrite,
+	flop.ErrObjectExists:              exitCannotWrite,
+	flop.ErrFileChanged:               exitCannotWrite,
+	flop.ErrPathEscapesRoot:           exitCannotWrite,
+	flop.ErrUnsafeObjectKey:           exitCannotWrite,
+	flop.ErrCannotSyncDir:             exitCannotWrite,
+	flop.ErrCannotDeleteDst:           exitCannotWrite,
+	flop.ErrConflictAborted:           exitFailure,
+	flop.ErrOmittingDir:               exitTypeConflict,
+	flop.ErrWithParentsDstMustBeDir:   exitTypeConflict,
+	flop.ErrCannotOverwriteNonDir:     exitTypeConflict,
+	flop.ErrWritingFileToExistingDir:  exitTypeConflict,
+	flop.ErrTargetNotDir:              exitTypeConflict,
+	flop.ErrSpecialFile:               exitTypeConflict,
+}
+
+// exitCode returns the exit code for err, from the outermost sentinel error in its chain.  The chain is
+// followed through the Kind and Err of each *flop.Error, Unwrap, and errors wrapped with github.com/pkg/errors.
+func exitCode(err error) int {
+	if err == nil {
+		return exitOK
+	}
+	for e := err; e != nil; e = unwrap(e) {
+		if code, ok := exitCodes[e]; ok {
+			return code
+		}
+		if flopErr, ok := e.(*flop.Error); ok {
+			if code, ok := exitCodes[flopErr.Kind]; ok {
+				return code
+			}
+		}
+	}
+	return exitFailure
+}
+
+// unwrap returns the error wrapped by err, or nil if there is none.
+func unwrap(err error) error {
+	if next := stderrors.Unwrap(err); next != nil {
+		return next
+	}
+	if causer, ok := err.(interface{ Cause() error }); ok {
+		if _, ok := err.(*flop.Error); !ok {
+			return causer.Cause()
+		}
+	}
+	return nil
+}
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+// config holds the parsed command line.
+type config struct {
+	opts            flop.Options
+	targetDirectory string
+	s3Endpoint      string
+	help            bool
+}
+
+// flags returns the flags understood by flop, applying them to cfg.
+func flags(cfg *config, stdout, stderr io.Writer) []flagSpec {
+	set := func(b *bool) func(string) error {
+		return func(string) error {
+			*b = true
+			return nil
+		}
+	}
+	return []flagSpec{
+		{short: 'b', usage: "like --backup but does not accept an argument", set: func(string) error {
+			cfg.opts.Backup, cfg.opts.BackupEnv = "env", true
+			return nil
+		}},
+		{long: "backup", arg: optionalArg, argName: "CONTROL", usage: "make a backup of each existing destination file", set: func(v string) error {
+			if v == "" {
+				// like cp, the control value comes from VERSION_CONTROL
+				v = "env"
+			}
+			cfg.opts.Backup, cfg.opts.BackupEnv = v, true
+			return nil
+		}},
+		{short: 'S', long: "suffix", arg: requiredArg, argName: "SUFFIX", usage: "override the usual backup suffix", set: func(v string) error {
+			cfg.opts.BackupSuffix = v
+			return nil
+		}},
+		{long: "backup-dir", arg: requiredArg, argName: "DIR", usage: "make backups in a mirrored tree under DIR", set: func(v string) error {
+			cfg.opts.BackupDir = v
+			return nil
+		}},
+		{long: "backup-time-layout", arg: requiredArg, argName: "LAYOUT", usage: "time layout used to name timestamped backups", set: func(v string) error {
+			cfg.opts.BackupTimeLayout = v
+			return nil
+		}},
+		{long: "backup-retain", arg: requiredArg, argName: "COUNT", usage: "keep only the newest COUNT numbered backups", set: func(v string) (err error) {
+			cfg.opts.BackupRetain.Count, err = strconv.Atoi(v)
+			return err
+		}},
+		{long: "backup-max-age", arg: requiredArg, argName: "DURATION", usage: "remove numbered backups older than DURATION", set: func(v string) (err error) {
+			cfg.opts.BackupRetain.MaxAge, err = time.ParseDuration(v)
+			return err
+		}},
+		{long: "bwlimit", arg: requiredArg, argName: "BYTES", usage: "limit copying to BYTES per second", set: func(v string) (err error) {
+			cfg.opts.BytesPerSecond, err = strconv.ParseInt(v, 10, 64)
+			return err
+		}},
+		{long: "append-name", usage: "copy a file SOURCE into DEST when DEST is a directory", set: set(&cfg.opts.AppendNameToPath)},
+		{long: "atomic", usage: "copy to a temporary file then rename it into place", set: set(&cfg.opts.Atomic)},
+		{long: "atomic-tree", usage: "copy a directory next to DEST then swap it into place", set: set(&cfg.opts.AtomicTree)},
+		{long: "confine-to", arg: requiredArg, argName: "DIR", usage: "refuse to write outside of DIR", set: func(v string) error {
+			cfg.opts.ConfineTo = v
+			return nil
+		}},
+		{long: "copy-special", usage: "recreate named pipes, device nodes and sockets", set: set(&cfg.opts.CopySpecial)},
+		{long: "durable", usage: "sync files and directories so copies survive a crash", set: set(&cfg.opts.Durable)},
+		{short: 'l', long: "link", usage: "hard link files instead of copying", set: set(&cfg.opts.Link)},
+		{long: "mkdir-all", usage: "create missing destination directories", set: set(&cfg.opts.MkdirAll)},
+		{short: 'n', long: "no-clobber", usage: "do not overwrite an existing file", set: set(&cfg.opts.NoClobber)},
+		{long: "parents", usage: "use full source file name under DIRECTORY", set: set(&cfg.opts.Parents)},
+		{long: "preserve", arg: optionalArg, argName: "ATTR_LIST", usage: "preserve the attributes mode and links", set: func(v string) error {
+			return preserve(&cfg.opts, v, stderr)
+		}},
+		{short: 'r', long: "recursive", usage: "copy directories recursively", set: set(&cfg.opts.Recursive)},
+		{short: 'R', usage: "same as --recursive", set: set(&cfg.opts.Recursive)},
+		{short: 't', long: "target-directory", arg: requiredArg, argName: "DIRECTORY", usage: "copy all SOURCE arguments into DIRECTORY", set: func(v string) error {
+			cfg.targetDirectory = v
+			cfg.opts.TargetDirectory = true
+			return nil
+		}},
+		{long: "resume", usage: "continue copies interrupted part way through a file", set: set(&cfg.opts.Resume)},
+		{short: 'T', long: "no-target-directory", usage: "treat DEST as a normal file", set: set(&cfg.opts.NoTargetDirectory)},
+		{short: 'x', long: "one-file-system", usage: "stay on this file system", set: set(&cfg.opts.OneFileSystem)},
+		{short: 'v', long: "verbose", usage: "explain what is being done", set: func(string) error {
+			cfg.opts.InfoLogFunc = func(msg string) { fmt.Fprintln(stdout, msg) }
+			return nil
+		}},
+		{long: "debug", usage: "explain how a file is copied, implies -v", set: func(string) error {
+			cfg.opts.InfoLogFunc = func(msg string) { fmt.Fprintln(stdout, msg) }
+			cfg.opts.DebugLogFunc = func(msg string) { fmt.Fprintln(stderr, msg) }
+			return nil
+		}},
+		{long: "s3-endpoint", arg: requiredArg, argName: "URL", usage: "endpoint of the service for s3:// paths", set: func(v string) error {
+			cfg.s3Endpoint = v
+			return nil
+		}},
+		{short: 'h', long: "help", usage: "display this help and exit", set: set(&cfg.help)},
+	}
+}
+
+// preserve applies a --preserve attribute list.  Permissions are always preserved, so "mode" needs nothing
+// more, and "links" preserves hard links.  Like cp, an empty list means "mode,ownership,timestamps", of which
+// only mode is supported, so the others are skipped with a warning rather than failing.
+func preserve(opts *flop.Options, list string, stderr io.Writer) error {
+	if list == "" {
+		fmt.Fprintln(stderr, "flop: warning: preserving 'ownership' and 'timestamps' is not supported, preserving 'mode' only")
+		return nil
+	}
+	for _, attr := range strings.Split(list, ",") {
+		switch attr {
+		case "mode":
+		case "links":
+			opts.PreserveHardLinks = true
+		default:
+			return fmt.Errorf("preserving '%s' is not supported", attr)
+		}
+	}
+	return nil
+}
+
+// run executes the command with args, returning the exit code.
+func run(args []string, stdout, stderr io.Writer) int {
+	var cfg config
+	specs := flags(&cfg, stdout, stderr)
+	operands, err := parseFlags(specs, args)
+	if err != nil {
+		fmt.Fprintf(stderr, "flop: %s\nTry 'flop --help' for more information.\n", err)
+		return exitUsage
+	}
+	if cfg.help {
+		fmt.Fprintf(stdout, "Usage: flop [OPTION]... [-T] SOURCE DEST\n  or:  flop [OPTION]... SOURCE... DIRECTORY\n  or:  flop [OPTION]... -t DIRECTORY SOURCE...\n\n%s", usage(specs))
+		return exitOK
+	}
+	if len(operands) < 1 || (len(operands) < 2 && cfg.targetDirectory == "") {
+		fmt.Fprintf(stderr, "flop: missing file operand\nTry 'flop --help' for more information.\n")
+		return exitUsage
+	}
+	cfg.opts.ObjectStores = objectStores(append(operands, cfg.targetDirectory), cfg.s3Endpoint)
+
+	srcs, dst := operands[:len(operands)-1], operands[len(operands)-1]
+	if cfg.targetDirectory != "" {
+		srcs, dst = operands, cfg.targetDirectory
+	}
+	return report(stderr, flop.CopyMany(srcs, dst, cfg.opts))
+}
+
+// report prints err if it is not nil and returns the matching exit code.
+func report(stderr io.Writer, err error) int {
+	if err != nil {
+		fmt.Fprintf(stderr, "flop: %s\n", err)
+	}
+	return exitCode(err)
+}
+
+// objectStores creates an s3 client for each bucket named by an s3:// operand.
+func objectStores(operands []string, endpoint string) map[string]flop.ObjectStore {
+	if endpoint == "" {
+		endpoint = os.Getenv("AWS_ENDPOINT_URL")
+	}
+	region := os.Getenv("AWS_REGION")
+	if endpoint == "" {
+		endpoint = "https://s3.amazonaws.com"
+		if region != "" {
+			endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", region)
+		}
+	}
+
+	stores := map[string]flop.ObjectStore{}
+	for _, op := range operands {
+		if !strings.HasPrefix(op, "s3://") {
+			continue
+		}
+		bucket := strings.SplitN(strings.TrimPrefix(op, "s3://"), "/", 2)[0]
+		c := s3.NewClient(endpoint, bucket, os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY"))
+		c.SessionToken = os.Getenv("AWS_SESSION_TOKEN")
+		c.Region = region
+		stores[bucket] = c
+	}
+	return stores
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/homedepot/flop"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseFlags(t *testing.T) {
+	assert := assert.New(t)
+	tests := []struct {
+		name         string
+		args         []string
+		expectOpts   flop.Options
+		expectOps    []string
+		errSubstring string
+	}{
+		{
+			name:       "combined_short_flags",
+			args:       []string{"-rn", "a", "b"},
+			expectOpts: flop.Options{Recursive: true, NoClobber: true},
+			expectOps:  []string{"a", "b"},
+		},
+		{
+			name:       "backup_without_value",
+			args:       []string{"a", "--backup", "b"},
+			expectOpts: flop.Options{Backup: "env", BackupEnv: true},
+			expectOps:  []string{"a", "b"},
+		},
+		{
+			name:       "backup_with_value",
+			args:       []string{"--backup=numbered", "-l", "a", "b"},
+			expectOpts: flop.Options{Backup: "numbered", BackupEnv: true, Link: true},
+			expectOps:  []string{"a", "b"},
+		},
+		{
+			name:       "abbreviated_long_flag",
+			args:       []string{"--par", "--recur", "a", "b"},
+			expectOpts: flop.Options{Parents: true, Recursive: true},
+			expectOps:  []string{"a", "b"},
+		},
+		{
+			name:       "one_file_system",
+			args:       []string{"-rx", "a", "b"},
+			expectOpts: flop.Options{Recursive: true, OneFileSystem: true},
+			expectOps:  []string{"a", "b"},
+		},
+		{
+			name:       "bandwidth_limit",
+			args:       []string{"--bwlimit=1048576", "a", "b"},
+			expectOpts: flop.Options{BytesPerSecond: 1048576},
+			expectOps:  []string{"a", "b"},
+		},
+		{
+			name:       "double_dash_ends_flags",
+			args:       []string{"-R", "--", "-a", "b"},
+			expectOpts: flop.Options{Recursive: true},
+			expectOps:  []string{"-a", "b"},
+		},
+		{
+			name:       "suffix_as_next_argument",
+			args:       []string{"-bS", ".bak", "a", "b"},
+			expectOpts: flop.Options{Backup: "env", BackupEnv: true, BackupSuffix: ".bak"},
+			expectOps:  []string{"a", "b"},
+		},
+		{
+			name:       "append_name",
+			args:       []string{"--append-name", "a", "b"},
+			expectOpts: flop.Options{AppendNameToPath: true},
+			expectOps:  []string{"a", "b"},
+		},
+		{
+			name:       "atomic",
+			args:       []string{"--atomic", "a", "b"},
+			expectOpts: flop.Options{Atomic: true},
+			expectOps:  []string{"a", "b"},
+		},
+		{
+			name:       "atomic_tree",
+			args:       []string{"-r", "--atomic-tree", "a", "b"},
+			expectOpts: flop.Options{Recursive: true, AtomicTree: true},
+			expectOps:  []string{"a", "b"},
+		},
+		{
+			name:       "durable",
+			args:       []string{"--durable", "a", "b"},
+			expectOpts: flop.Options{Durable: true},
+			expectOps:  []string{"a", "b"},
+		},
+		{
+			name:       "confine_to",
+			args:       []string{"--confine-to", "/srv", "a", "b"},
+			expectOpts: flop.Options{ConfineTo: "/srv"},
+			expectOps:  []string{"a", "b"},
+		},
+		{
+			name:       "preserve_links",
+			args:       []string{"-r", "--preserve=mode,links", "a", "b"},
+			expectOpts: flop.Options{Recursive: true, PreserveHardLinks: true},
+			expectOps:  []string{"a", "b"},
+		},
+		{
+			name:       "copy_special",
+			args:       []string{"--copy-special", "a", "b"},
+			expectOpts: flop.Options{CopySpecial: true},
+			expectOps:  []string{"a", "b"},
+		},
+		{
+			name:       "resume",
+			args:       []string{"--resume", "a", "b"},
+			expectOpts: flop.Options{Resume: true},
+			expectOps:  []string{"a", "b"},
+		},
+		{
+			name:         "archive_is_not_atomic",
+			args:         []string{"-a", "a", "b"},
+			errSubstring: "invalid option -- 'a'",
+		},
+		{
+			name:       "preserve_defaults",
+			args:       []string{"--preserve", "a", "b"},
+			expectOpts: flop.Options{},
+			expectOps:  []string{"a", "b"},
+		},
+		{
+			name:         "preserve_unsupported_attribute",
+			args:         []string{"--preserve=mode,ownership", "a", "b"},
+			errSubstring: "preserving 'ownership' is not supported",
+		},
+		{
+			name:         "unknown_short_flag",
+			args:         []string{"-j"},
+			errSubstring: "invalid option -- 'j'",
+		},
+		{
+			name:         "unknown_long_flag",
+			args:         []string{"--bogus"},
+			errSubstring: "unrecognized option '--bogus'",
+		},
+		{
+			name:         "value_for_flag_without_argument",
+			args:         []string{"--link=yes"},
+			errSubstring: "doesn't allow an argument",
+		},
+		{
+			name:         "missing_required_argument",
+			args:         []string{"--s3-endpoint"},
+			errSubstring: "requires an argument",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var cfg config
+			ops, err := parseFlags(flags(&cfg, ioutil.Discard, ioutil.Discard), tt.args)
+			if tt.errSubstring != "" {
+				assert.Contains(err.Error(), tt.errSubstring)
+				return
+			}
+			assert.Nil(err)
+			assert.Equal(tt.expectOps, ops)
+			assert.Equal(tt.expectOpts, cfg.opts)
+		})
+	}
+}
+
+func TestExitCode(t *testing.T) {
+	assert := assert.New(t)
+	assert.Equal(exitOK, exitCode(nil))
+	assert.Equal(exitNotExist, exitCode(errors.Wrapf(flop.ErrFileNotExist, "source file %s", "a")))
+	assert.Equal(exitTypeConflict, exitCode(flop.ErrOmittingDir))
+	assert.Equal(exitFailure, exitCode(errors.New("unknown")))
+	assert.Equal(exitCannotWrite, exitCode(&flop.Error{Op: "confine", Dst: "b", Kind: flop.ErrPathEscapesRoot}))
+	assert.Equal(exitCannotWrite, exitCode(errors.Wrap(&flop.Error{Op: "remove", Dst: "b", Kind: flop.ErrCannotDeleteDst}, "sync")))
+	assert.Equal(exitFailure, exitCode(&flop.Error{Op: "copy", Src: "a", Dst: "b", Kind: flop.ErrConflictAborted}))
+	// the outermost sentinel decides
+	assert.Equal(exitCannotWrite, exitCode(&flop.Error{Op: "open", Kind: flop.ErrCannotOpenOrCreateDstFile, Err: &flop.Error{Kind: flop.ErrFileNotExist}}))
+}
+
+func TestRunCopiesMultipleSourcesIntoDir(t *testing.T) {
+	assert := assert.New(t)
+	tmp, err := ioutil.TempDir("", "")
+	assert.Nil(err)
+	a, b, dst := filepath.Join(tmp, "a"), filepath.Join(tmp, "b"), filepath.Join(tmp, "dst")
+	assert.Nil(os.MkdirAll(filepath.Join(a, "sub"), 0777))
+	assert.Nil(ioutil.WriteFile(filepath.Join(a, "sub", "f"), []byte("a"), 0644))
+	assert.Nil(ioutil.WriteFile(b, []byte("b"), 0644))
+	assert.Nil(os.Mkdir(dst, 0777))
+
+	var stdout, stderr bytes.Buffer
+	assert.Equal(exitOK, run([]string{"-rv", a, b, dst}, &stdout, &stderr), stderr.String())
+	assert.NotEmpty(stdout.String())
+
+	content, err := ioutil.ReadFile(filepath.Join(dst, "a", "sub", "f"))
+	assert.Nil(err)
+	assert.Equal([]byte("a"), content)
+	content, err = ioutil.ReadFile(filepath.Join(dst, "b"))
+	assert.Nil(err)
+	assert.Equal([]byte("b"), content)
+}
+
+func TestRunExitCodes(t *testing.T) {
+	assert := assert.New(t)
+	tmp, err := ioutil.TempDir("", "")
+	assert.Nil(err)
+	file, dir := filepath.Join(tmp, "file"), filepath.Join(tmp, "dir")
+	assert.Nil(ioutil.WriteFile(file, []byte("foo"), 0644))
+	assert.Nil(os.Mkdir(dir, 0777))
+
+	tests := []struct {
+		name string
+		args []string
+		code int
+	}{
+		{"missing_operand", []string{file}, exitUsage},
+		{"bad_flag", []string{"--bogus", file, dir}, exitUsage},
+		{"missing_source", []string{filepath.Join(tmp, "missing"), dir}, exitNotExist},
+		{"dir_without_recursive", []string{dir, filepath.Join(tmp, "other")}, exitTypeConflict},
+		{"multiple_sources_to_file", []string{file, file, file}, exitTypeConflict},
+		{"no_target_directory_with_dir", []string{"-T", file, dir}, exitTypeConflict},
+		{"copy_into_dir", []string{file, dir}, exitOK},
+		{"target_directory", []string{"-t", dir, file}, exitOK},
+		{"target_directory_is_file", []string{"--target-directory=" + file, file}, exitTypeConflict},
+		{"target_directory_and_no_target_directory", []string{"-T", "-t", dir, file}, exitUsage},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(tt.code, run(tt.args, ioutil.Discard, ioutil.Discard))
+		})
+	}
+}
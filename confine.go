@@ -0,0 +1,53 @@
+package flop
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// confinedRel returns path relative to Options.ConfineTo, or ErrPathEscapesRoot if path lies outside of it.
+func (o *Options) confinedRel(path string) (string, error) {
+	root, err := filepath.Abs(o.ConfineTo)
+	if err != nil {
+		return "", err
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(root, abs)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", &Error{Op: "confine", Dst: path, Kind: ErrPathEscapesRoot, Err: errors.Errorf("root %s", o.ConfineTo)}
+	}
+	return rel, nil
+}
+
+// confineDirByPath is the portable version of confineDir.  Each component of dir is checked with os.Lstat,
+// which leaves a window where a component could be swapped for a symbolic link after it is checked.
+func confineDirByPath(dir string, opts Options) error {
+	rel, err := opts.confinedRel(dir)
+	if err != nil {
+		return err
+	}
+	p := opts.ConfineTo
+	for _, name := range strings.Split(rel, string(filepath.Separator)) {
+		if name == "." {
+			continue
+		}
+		p = filepath.Join(p, name)
+		info, err := os.Lstat(p)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return &Error{Op: "confine", Dst: dir, Kind: ErrPathEscapesRoot, Err: errors.Errorf("symbolic link %s, root %s", p, opts.ConfineTo)}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+// +build linux
+
+package flop
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// confineResolve is the openat2 resolve flags used for every destination when Options.ConfineTo is set.
+const confineResolve = unix.RESOLVE_BENEATH | unix.RESOLVE_NO_SYMLINKS
+
+// openBeneath opens rel beneath the root directory with openat2, refusing to resolve symbolic links or leave
+// root.  unix.ENOSYS is returned by kernels older than 5.6.
+func openBeneath(root, rel string, flag int, perm os.FileMode) (int, error) {
+	rootFD, err := unix.Open(root, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return -1, &os.PathError{Op: "open", Path: root, Err: err}
+	}
+	defer unix.Close(rootFD)
+
+	for {
+		fd, err := unix.Openat2(rootFD, rel, &unix.OpenHow{
+			Flags:   uint64(flag | unix.O_CLOEXEC),
+			Mode:    uint64(perm.Perm()),
+			Resolve: confineResolve,
+		})
+		if err != unix.EINTR && err != unix.EAGAIN {
+			return fd, err
+		}
+	}
+}
+
+// escapeErr converts the errors openat2 returns for a path leaving root or containing a symbolic link to
+// ErrPathEscapesRoot.
+func escapeErr(path string, err error, opts Options) error {
+	if err == unix.EXDEV || err == unix.ELOOP {
+		return &Error{Op: "confine", Dst: path, Kind: ErrPathEscapesRoot, Err: errors.Errorf("root %s: %s", opts.ConfineTo, err)}
+	}
+	return &os.PathError{Op: "openat2", Path: path, Err: err}
+}
+
+// confineDir returns ErrPathEscapesRoot if dir, or its nearest existing parent, cannot be reached from
+// Options.ConfineTo without following a symbolic link.  It is a noop when ConfineTo is not set.
+func confineDir(dir string, opts Options) error {
+	if opts.ConfineTo == "" {
+		return nil
+	}
+	rel, err := opts.confinedRel(dir)
+	if err != nil {
+		return err
+	}
+	for p := rel; ; p = filepath.Dir(p) {
+		fd, err := openBeneath(opts.ConfineTo, p, unix.O_PATH, 0)
+		if err == unix.ENOSYS {
+			return confineDirByPath(dir, opts)
+		}
+		if err == nil {
+			return unix.Close(fd)
+		}
+		if err != unix.ENOENT || p == "." {
+			return escapeErr(dir, err, opts)
+		}
+	}
+}
@@ -0,0 +1,13 @@
+// +build !linux
+
+package flop
+
+// confineDir returns ErrPathEscapesRoot if dir, or its nearest existing parent, cannot be reached from
+// Options.ConfineTo without following a symbolic link.  It is a noop when ConfineTo is not set.  openat2 is
+// only available on Linux, so each component is checked by path.
+func confineDir(dir string, opts Options) error {
+	if opts.ConfineTo == "" {
+		return nil
+	}
+	return confineDirByPath(dir, opts)
+}
@@ -0,0 +1,101 @@
+package flop
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Decision is how Options.OnConflict resolves a copy to an existing destination file.
+type Decision int
+
+const (
+	// Overwrite replaces the destination, making a backup only if Options.Backup asks for one.
+	Overwrite Decision = iota
+	// Skip leaves the destination alone and does not copy the source.
+	Skip
+	// RenameNew copies the source next to the destination under the first unused name, like file-1.txt,
+	// leaving the destination alone.
+	RenameNew
+	// BackupThenOverwrite replaces the destination after making a backup of it.  The backup control value is
+	// taken from Options.Backup unless it turns backups off, defaulting to "existing" like cp -b.
+	BackupThenOverwrite
+	// Abort stops the copy with ErrConflictAborted.
+	Abort
+)
+
+// String returns the name of the decision.
+func (d Decision) String() string {
+	switch d {
+	case Overwrite:
+		return "overwrite"
+	case Skip:
+		return "skip"
+	case RenameNew:
+		return "rename-new"
+	case BackupThenOverwrite:
+		return "backup-then-overwrite"
+	case Abort:
+		return "abort"
+	}
+	return "Decision(" + strconv.Itoa(int(d)) + ")"
+}
+
+// renameNewPath returns the first path next to path, with a number added before the extension, that does not
+// exist.
+func renameNewPath(path string) string {
+	ext := filepath.Ext(path)
+	base := strings.TrimSuffix(path, ext)
+	for i := 1; ; i++ {
+		p := base + "-" + strconv.Itoa(i) + ext
+		if _, err := os.Lstat(p); os.IsNotExist(err) {
+			return p
+		}
+	}
+}
+
+// resolveConflict applies Options.NoClobber and Options.OnConflict before src, described by srcInfo, is copied
+// over the existing dstFile.  It returns the File to write, a new one for RenameNew, or nil when the
+// destination is kept, along with opts asking for a backup after BackupThenOverwrite.  A dstFile which does not
+// exist is returned as it is.
+func resolveConflict(src string, srcInfo os.FileInfo, dstFile *File, opts Options) (*File, Options, error) {
+	if !dstFile.existOnInit {
+		return dstFile, opts, nil
+	}
+	if opts.NoClobber {
+		opts.logDebug("dst exists, will not clobber", "dst", dstFile.Path)
+		opts.Hooks.onSkip(src, dstFile.Path, "no clobber")
+		return nil, opts, nil
+	}
+	if opts.OnConflict == nil {
+		return dstFile, opts, nil
+	}
+
+	decision, err := opts.OnConflict(srcInfo, dstFile.fileInfoOnInit)
+	if err != nil {
+		return nil, opts, err
+	}
+	opts.logDebug("dst exists, resolved conflict", "dst", dstFile.Path, "decision", decision)
+	switch decision {
+	case Overwrite:
+	case Skip:
+		opts.Hooks.onSkip(src, dstFile.Path, "conflict")
+		return nil, opts, nil
+	case RenameNew:
+		dstFile = NewFile(renameNewPath(dstFile.Path))
+		opts.logDebug("because of conflict, setting dst path", "dst", dstFile.Path)
+		_ = dstFile.setInfo()
+	case BackupThenOverwrite:
+		if !makesBackup(opts.backupControl()) {
+			opts.Backup = "existing"
+		}
+	case Abort:
+		return nil, opts, &Error{Op: "copy", Src: src, Dst: dstFile.Path, Kind: ErrConflictAborted}
+	default:
+		return nil, opts, &Error{Op: "copy", Src: src, Dst: dstFile.Path, Kind: ErrConflictAborted, Err: errors.Errorf("unknown decision %s", decision)}
+	}
+	return dstFile, opts, nil
+}
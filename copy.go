@@ -3,19 +3,23 @@
 package flop
 
 import (
-	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
+	"path"
 	"path/filepath"
-	"regexp"
-	"strconv"
+	"strings"
+	"time"
 
 	"github.com/pkg/errors"
 )
 
-// numberedBackupFile matches files that looks like file.ext.~1~ and uses a capture group to grab the number
-var numberedBackupFile = regexp.MustCompile(`^.*\.~([0-9]{1,5})~$`)
+// rename is used to move atomic copies into place.  It is a variable so tests can simulate failures.
+var rename = os.Rename
+
+// deviceOf returns the device holding a file, used to find mount points.  It is a variable so tests can
+// simulate mount points.
+var deviceOf = fileDevice
 
 // File describes a file on the filesystem.
 type File struct {
@@ -98,50 +102,89 @@ func SimpleCopy(src, dst string) error {
 // Copy will copy src to dst.  Behavior is determined by the given Options.
 func Copy(src, dst string, opts Options) (err error) {
 	opts.setLoggers()
+	if opts.dstRoot == "" {
+		opts.dstRoot = dst
+	}
+	// a single Limiter is shared by every file in the tree
+	opts.Limiter = opts.limiter()
+	if isObjectURL(src) || isObjectURL(dst) {
+		return copyObjects(src, dst, opts)
+	}
 	srcFile, dstFile := NewFile(src), NewFile(dst)
 
 	// set src attributes
 	if err := srcFile.setInfo(); err != nil {
-		return errors.Wrapf(ErrCannotStatFile, "source file %s: %s", srcFile.Path, err)
+		return &Error{Op: "stat", Src: srcFile.Path, Kind: ErrCannotStatFile, Err: err}
 	}
 	if !srcFile.existOnInit {
-		return errors.Wrapf(ErrFileNotExist, "source file %s", srcFile.Path)
+		return &Error{Op: "stat", Src: srcFile.Path, Kind: ErrFileNotExist}
 	}
-	opts.logDebug("src %s existOnInit: %t", srcFile.Path, srcFile.existOnInit)
+	opts.logDebug("stat src", "src", srcFile.Path, "existOnInit", srcFile.existOnInit)
 
 	// stat dst attributes. handle errors later
 	_ = dstFile.setInfo()
-	opts.logDebug("dst %s existOnInit: %t", dstFile.Path, dstFile.existOnInit)
+	opts.logDebug("stat dst", "dst", dstFile.Path, "existOnInit", dstFile.existOnInit)
 
 	if dstFile.shouldMakeParents(opts) {
 		opts.mkdirAll = true
-		opts.DebugLogFunc("dst mkdirAll: true")
+		opts.logDebug("dst needs parent dirs", "dst", dstFile.Path, "mkdirAll", true)
 	}
 
 	if opts.Parents {
 		if dstFile.existOnInit && !dstFile.isDir {
-			return ErrWithParentsDstMustBeDir
+			return &Error{Op: "copy", Src: srcFile.Path, Dst: dstFile.Path, Kind: ErrWithParentsDstMustBeDir}
 		}
 		// TODO: figure out how to handle windows paths where they reference the full path like c:/dir
-		dstFile.Path = filepath.Join(dstFile.Path, srcFile.Path)
-		opts.logDebug("because of Parents option, setting dst Path to %s", dstFile.Path)
-		dstFile.isDir = srcFile.isDir
+		dstFile = NewFile(filepath.Join(dstFile.Path, srcFile.Path))
+		opts.logDebug("because of Parents option, setting dst path", "dst", dstFile.Path)
+		_ = dstFile.setInfo()
 		opts.Parents = false // ensure we don't keep creating parents on recursive calls
 	}
 
 	// copying src directory requires dst is also a directory, if it existOnInit
 	if srcFile.isDir && dstFile.existOnInit && !dstFile.isDir {
-		return errors.Wrapf(
-			ErrCannotOverwriteNonDir, "source directory %s, destination file %s", srcFile.Path, dstFile.Path)
+		return &Error{Op: "copy", Src: srcFile.Path, Dst: dstFile.Path, Kind: ErrCannotOverwriteNonDir}
 	}
 
 	// divide and conquer
 	switch {
 	case opts.Link:
-		return hardLink(srcFile, dstFile, opts.logDebug)
+		if err := opts.Hooks.beforeCopy(srcFile.Path, dstFile.Path); err != nil {
+			return err
+		}
+		dir, err := openParent(dstFile.Path, opts)
+		if err != nil {
+			return err
+		}
+		defer dir.close()
+		if err := opts.Journal.record(dstFile.Path, true, opts); err != nil {
+			return err
+		}
+		if err := hardLink(dir, srcFile, dstFile, opts); err != nil {
+			return err
+		}
+		return syncParent(dstFile.Path, opts)
 	case srcFile.isSymlink():
 		// FIXME: we really need to copy the pass through dest unless they specify otherwise...check the docs
-		return copyLink(srcFile, dstFile, opts.logDebug)
+		if err := opts.Hooks.beforeCopy(srcFile.Path, dstFile.Path); err != nil {
+			return err
+		}
+		dir, err := openParent(dstFile.Path, opts)
+		if err != nil {
+			return err
+		}
+		defer dir.close()
+		if err := opts.Journal.record(dstFile.Path, true, opts); err != nil {
+			return err
+		}
+		if err := copyLink(dir, srcFile, dstFile, opts); err != nil {
+			return err
+		}
+		return syncParent(dstFile.Path, opts)
+	case srcFile.isSpecial():
+		return copySpecial(srcFile, dstFile, opts)
+	case srcFile.isDir && opts.AtomicTree:
+		return copyTreeAtomic(srcFile, dstFile, opts)
 	case srcFile.isDir:
 		return copyDir(srcFile, dstFile, opts)
 	default:
@@ -149,42 +192,138 @@ func Copy(src, dst string, opts Options) (err error) {
 	}
 }
 
-// hardLink creates a hard link to src at dst.
-func hardLink(src, dst *File, logFunc func(format string, a ...interface{})) error {
-	logFunc("creating hard link to src %s at dst %s", src.Path, dst.Path)
-	return os.Link(src.Path, dst.Path)
+// CopyMany will copy each of srcs into dstDir, like cp given several sources.  When more than one source is
+// given, or Options.TargetDirectory is set, dstDir must be an existing directory and each source is copied to
+// a path with the same base name inside it.  Options.NoTargetDirectory instead treats dstDir as a normal
+// destination and only allows a single source.  Copying stops at the first error.
+func CopyMany(srcs []string, dstDir string, opts Options) error {
+	opts.setLoggers()
+	opts.Limiter = opts.limiter()
+	if len(srcs) == 0 {
+		return &Error{Op: "copy", Dst: dstDir, Kind: ErrMissingSrc}
+	}
+	if opts.TargetDirectory && opts.NoTargetDirectory {
+		return &Error{Op: "copy", Dst: dstDir, Kind: ErrTargetDirectoryConflict}
+	}
+
+	if opts.NoTargetDirectory {
+		if len(srcs) > 1 {
+			return &Error{Op: "copy", Src: srcs[1], Dst: dstDir, Kind: ErrTooManySrcs}
+		}
+		return Copy(srcs[0], dstDir, opts)
+	}
+
+	dstIsDir := isDirPath(dstDir)
+	if !dstIsDir && (len(srcs) > 1 || opts.TargetDirectory) {
+		return &Error{Op: "copy", Dst: dstDir, Kind: ErrTargetNotDir}
+	}
+
+	for _, src := range srcs {
+		dst := dstDir
+		if dstIsDir && !opts.Parents {
+			dst = joinBase(dstDir, src)
+		}
+		opts.logDebug("copying src to dst", "src", src, "dst", dst)
+		if err := Copy(src, dst, opts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isDirPath returns true if path is an existing directory, or an object store prefix ending in '/'.
+func isDirPath(path string) bool {
+	if isObjectURL(path) {
+		return strings.HasSuffix(path, "/")
+	}
+	info, err := os.Stat(path)
+	return err == nil && info.IsDir()
+}
+
+// joinBase returns the path of src's base name inside dir.
+func joinBase(dir, src string) string {
+	base := filepath.Base(src)
+	if isObjectURL(src) {
+		base = path.Base(src)
+	}
+	if isObjectURL(dir) {
+		return strings.TrimSuffix(dir, "/") + "/" + base
+	}
+	return filepath.Join(dir, base)
+}
+
+// hardLink creates a hard link to src at dst, in the directory dir opened for dst.
+func hardLink(dir *dstDir, src, dst *File, opts Options) error {
+	opts.logDebug("creating hard link to src at dst", "src", src.Path, "dst", dst.Path)
+	if err := dir.link(src.Path, filepath.Base(dst.Path)); err != nil {
+		return &Error{Op: "link", Src: src.Path, Dst: dst.Path, Kind: ErrCannotOpenOrCreateDstFile, Err: err}
+	}
+	opts.Hooks.onLink(src.Path, dst.Path)
+	return nil
 }
 
-// copyLink copies a symbolic link from src to dst.
-func copyLink(src, dst *File, logFunc func(format string, a ...interface{})) error {
-	logFunc("copying sym link %s to %s", src.Path, dst.Path)
+// copyLink copies a symbolic link from src to dst, in the directory dir opened for dst.
+func copyLink(dir *dstDir, src, dst *File, opts Options) error {
+	opts.logDebug("copying sym link", "src", src.Path, "dst", dst.Path)
 	linkSrc, err := os.Readlink(src.Path)
 	if err != nil {
-		return err
+		return &Error{Op: "readlink", Src: src.Path, Kind: ErrCannotOpenSrc, Err: err}
+	}
+	if err := dir.symlink(linkSrc, filepath.Base(dst.Path)); err != nil {
+		return &Error{Op: "symlink", Src: src.Path, Dst: dst.Path, Kind: ErrCannotOpenOrCreateDstFile, Err: err}
 	}
-	return os.Symlink(linkSrc, dst.Path)
+	opts.Hooks.onSymlink(src.Path, dst.Path, linkSrc)
+	return nil
 }
 
 func copyDir(srcFile, dstFile *File, opts Options) error {
 	if !opts.Recursive {
-		return errors.Wrapf(ErrOmittingDir, "source directory %s", srcFile.Path)
+		return &Error{Op: "copy", Src: srcFile.Path, Dst: dstFile.Path, Kind: ErrOmittingDir}
 	}
 	if opts.mkdirAll {
-		opts.logDebug("making all dirs up to %s", dstFile.Path)
-		if err := os.MkdirAll(dstFile.Path, srcFile.fileInfoOnInit.Mode()); err != nil {
+		opts.logDebug("making all dirs", "dir", dstFile.Path)
+		if err := mkdirAll(dstFile.Path, srcFile.fileInfoOnInit.Mode(), opts); err != nil {
 			return err
 		}
 	}
 
 	srcDirEntries, err := ioutil.ReadDir(srcFile.Path)
 	if err != nil {
-		return errors.Wrapf(ErrReadingSrcDir, "source directory %s: %s", srcFile.Path, err)
+		return &Error{Op: "readdir", Src: srcFile.Path, Kind: ErrReadingSrcDir, Err: err}
+	}
+	if opts.PreserveHardLinks && opts.hardLinks == nil {
+		opts.hardLinks = &hardLinks{copies: map[inode]string{}}
+	}
+	if opts.OneFileSystem && opts.srcDev == nil {
+		if dev, ok := deviceOf(srcFile.fileInfoOnInit); ok {
+			opts.srcDev = &dev
+		}
 	}
 
 	for _, entry := range srcDirEntries {
 		newSrc := filepath.Join(srcFile.Path, entry.Name())
 		newDst := filepath.Join(dstFile.Path, entry.Name())
-		opts.logDebug("recursive cp with src %s and dst %s", newSrc, newDst)
+		if entry.Mode()&specialModes != 0 && !opts.CopySpecial {
+			opts.logInfo("skipping special file", "src", newSrc)
+			opts.Hooks.onSkip(newSrc, newDst, "special file")
+			continue
+		}
+		if opts.srcDev != nil && entry.IsDir() {
+			if dev, ok := deviceOf(entry); ok && dev != *opts.srcDev {
+				opts.logInfo("skipping mount point, it is on a different file system", "src", newSrc)
+				opts.Hooks.onSkip(newSrc, newDst, "mount point")
+				continue
+			}
+		}
+		if opts.hardLinks != nil && !opts.Link {
+			if first, ok := opts.hardLinks.firstCopy(entry); ok {
+				if err := linkToCopy(first, newDst, entry, opts); err != nil {
+					return err
+				}
+				continue
+			}
+		}
+		opts.logDebug("recursive cp", "src", newSrc, "dst", newDst)
 		if err := Copy(
 			newSrc,
 			newDst,
@@ -199,83 +338,173 @@ func copyDir(srcFile, dstFile *File, opts Options) error {
 func copyFile(srcFile, dstFile *File, opts Options) (err error) {
 	// shortcut if files are the same file
 	if os.SameFile(srcFile.fileInfoOnInit, dstFile.fileInfoOnInit) {
-		opts.logDebug("src %s is same file as dst %s", srcFile.Path, dstFile.Path)
+		opts.logDebug("src is same file as dst", "src", srcFile.Path, "dst", dstFile.Path)
+		opts.Hooks.onSkip(srcFile.Path, dstFile.Path, "same file")
 		return nil
 	}
 
-	// optionally make dst parent directories
-	if dstFile.shouldMakeParents(opts) {
-		// TODO: permissive perms here to ensure tmp file can write on nix.. ensure we are setting these correctly down the line or fix here
-		if err := os.MkdirAll(filepath.Dir(dstFile.Path), 0777); err != nil {
-			return err
+	if dstFile.existOnInit && dstFile.isDir {
+		// optionally append src file name to dst dir like cp does
+		if !opts.AppendNameToPath {
+			return &Error{Op: "copy", Src: srcFile.Path, Dst: dstFile.Path, Kind: ErrWritingFileToExistingDir}
 		}
+		dstFile = NewFile(filepath.Join(dstFile.Path, filepath.Base(srcFile.Path)))
+		opts.logDebug("because of AppendNameToPath option, setting dst path", "dst", dstFile.Path)
+		// start over with the new dst, which must not be a directory itself
+		_ = dstFile.setInfo()
+		opts.AppendNameToPath = false
+		return copyFile(srcFile, dstFile, opts)
 	}
 
-	if dstFile.existOnInit {
-		if dstFile.isDir {
-			// optionally append src file name to dst dir like cp does
-			if opts.AppendNameToPath {
-				dstFile.Path = filepath.Join(dstFile.Path, filepath.Base(srcFile.Path))
-				opts.logDebug("because of AppendNameToPath option, setting dst path to %s", dstFile.Path)
-			} else {
-				return errors.Wrapf(ErrWritingFileToExistingDir, "destination directory %s", dstFile.Path)
-			}
-		}
+	// optionally keep the existing dst file, or let the client resolve the conflict with it
+	dstFile, opts, err = resolveConflict(srcFile.Path, srcFile.fileInfoOnInit, dstFile, opts)
+	if err != nil || dstFile == nil {
+		return err
+	}
 
-		// optionally do not clobber existing dst file
-		if opts.NoClobber {
-			opts.logDebug("dst %s exists, will not clobber", dstFile.Path)
-			return nil
-		}
+	if err := opts.Hooks.beforeCopy(srcFile.Path, dstFile.Path); err != nil {
+		return err
+	}
 
-		if opts.Backup != "" {
-			if err := backupFile(dstFile, opts.Backup, opts); err != nil {
-				return err
-			}
+	// optionally make dst parent directories
+	if dstFile.shouldMakeParents(opts) {
+		// TODO: permissive perms here to ensure tmp file can write on nix.. ensure we are setting these correctly down the line or fix here
+		if err := mkdirAll(filepath.Dir(dstFile.Path), 0777, opts); err != nil {
+			return err
 		}
-
 	}
 
 	srcFD, err := os.Open(srcFile.Path)
 	if err != nil {
-		return errors.Wrapf(ErrCannotOpenSrc, "source file %s: %s", srcFile.Path, err)
+		return &Error{Op: "open", Src: srcFile.Path, Kind: ErrCannotOpenSrc, Err: err}
 	}
 	defer func() {
 		if closeErr := srcFD.Close(); closeErr != nil {
 			err = closeErr
 		}
 	}()
+	start := time.Now()
+	var written int64
+	// make sure the file opened is the file that was stat'ed
+	if info, err := srcFD.Stat(); err != nil || !os.SameFile(info, srcFile.fileInfoOnInit) {
+		return &Error{Op: "open", Src: srcFile.Path, Kind: ErrFileChanged}
+	}
+
+	dir, err := openDstDir(filepath.Dir(dstFile.Path), opts)
+	if err != nil {
+		switch {
+		case errors.Cause(err) == ErrPathEscapesRoot:
+			return err
+		case opts.Atomic:
+			return &Error{Op: "open", Dst: filepath.Dir(dstFile.Path), Kind: ErrCannotCreateTmpFile, Err: err}
+		default:
+			return &Error{Op: "open", Dst: filepath.Dir(dstFile.Path), Kind: ErrCannotOpenOrCreateDstFile, Err: err}
+		}
+	}
+	defer dir.close()
 
 	if opts.Atomic {
-		dstDir := filepath.Dir(dstFile.Path)
-		tmpFD, err := ioutil.TempFile(dstDir, "copyfile-")
-		defer closeAndRemove(tmpFD, opts.logDebug)
+		var tmpFD *os.File
+		var partial *resumable
+		if opts.Resume {
+			// a resumable tmp file is kept on any error, so the next copy can continue it
+			partial, err = dir.openResumable(srcFD, srcFile, dstFile)
+			if partial != nil {
+				tmpFD = partial.fd
+				defer tmpFD.Close()
+			}
+		} else {
+			tmpFD, err = dir.createTemp("copyfile-")
+			defer closeAndRemove(tmpFD, opts)
+		}
 		if err != nil {
-			return errors.Wrapf(ErrCannotCreateTmpFile, "destination directory %s: %s", dstDir, err)
+			return &Error{Op: "create", Dst: dir.path, Kind: ErrCannotCreateTmpFile, Err: err}
 		}
-		opts.logDebug("created tmp file %s", tmpFD.Name())
+		opts.logDebug("created tmp file", "tmp", tmpFD.Name())
 
 		//copy src to tmp and cleanup on any error
-		opts.logInfo("copying src file %s to tmp file %s", srcFD.Name(), tmpFD.Name())
-		if _, err := io.Copy(tmpFD, srcFD); err != nil {
+		opts.logInfo("copying src file to tmp file", "src", srcFD.Name(), "tmp", tmpFD.Name())
+		if partial != nil {
+			written, err = partial.copy(opts.throttle(srcFD))
+		} else {
+			written, err = io.Copy(tmpFD, opts.throttle(srcFD))
+		}
+		if err != nil {
 			return err
 		}
 		if err := tmpFD.Sync(); err != nil {
 			return err
 		}
+		if err := setPermissions(tmpFD, dstFile, srcFile.fileInfoOnInit.Mode(), opts); err != nil {
+			return err
+		}
+		tmpInfo, err := tmpFD.Stat()
+		if err != nil {
+			return err
+		}
 		if err := tmpFD.Close(); err != nil {
 			return err
 		}
 
+		// back up dst only once the new content is ready, undoing the backup if the rename fails
+		commitBackup, rollbackBackup, err := linkBackup(dstFile, opts.backupControl(), opts)
+		if err != nil {
+			return err
+		}
+
 		// move tmp to dst
-		opts.logInfo("renaming tmp file %s to dst %s", tmpFD.Name(), dstFile.Path)
-		if err := os.Rename(tmpFD.Name(), dstFile.Path); err != nil {
-			return errors.Wrapf(ErrCannotRenameTempFile, "attempted to rename temp transfer file %s to %s", tmpFD.Name(), dstFile.Path)
+		if err := opts.Journal.record(dstFile.Path, true, opts); err != nil {
+			rollbackBackup()
+			return err
+		}
+		if err := dir.verify(dstFile); err != nil {
+			rollbackBackup()
+			return err
+		}
+		opts.logInfo("renaming tmp file to dst", "tmp", tmpFD.Name(), "dst", dstFile.Path)
+		if err := rename(tmpFD.Name(), dstFile.Path); err != nil {
+			rollbackBackup()
+			return &Error{Op: "rename", Src: tmpFD.Name(), Dst: dstFile.Path, Kind: ErrCannotRenameTempFile, Err: err}
+		}
+		commitBackup()
+		if partial != nil {
+			partial.finish()
+		}
+		if err := dir.verifyRenamed(filepath.Base(dstFile.Path), tmpInfo); err != nil {
+			return err
+		}
+		if err := syncParent(dstFile.Path, opts); err != nil {
+			return err
 		}
 	} else {
-		dstFD, err := os.Create(dstFile.Path)
-		if err != nil {
-			return errors.Wrapf(ErrCannotOpenOrCreateDstFile, "destination file %s: %s", dstFile.Path, err)
+		// with Resume a dst holding the start of src is continued, it is not worth a backup
+		var dstFD *os.File
+		var offset int64
+		if opts.Resume && dstFile.existOnInit {
+			if dstFD, offset, err = dir.openPartial(srcFD, srcFile, dstFile); err != nil {
+				return err
+			}
+		}
+		if dstFD != nil {
+			opts.logInfo("resuming partial dst file", "dst", dstFile.Path, "offset", offset)
+		} else if control := opts.backupControl(); control != "" && dstFile.existOnInit {
+			if err := backupFile(dstFile, control, opts); err != nil {
+				return err
+			}
+		}
+		if err := opts.Journal.record(dstFile.Path, false, opts); err != nil {
+			if dstFD != nil {
+				_ = dstFD.Close()
+			}
+			return err
+		}
+		if dstFD == nil {
+			if dstFD, err = dir.create(dstFile); err != nil {
+				if cause := errors.Cause(err); cause == ErrFileChanged || cause == ErrPathEscapesRoot {
+					return err
+				}
+				return &Error{Op: "create", Dst: dstFile.Path, Kind: ErrCannotOpenOrCreateDstFile, Err: err}
+			}
 		}
 		defer func() {
 			if closeErr := dstFD.Close(); closeErr != nil {
@@ -283,92 +512,34 @@ func copyFile(srcFile, dstFile *File, opts Options) (err error) {
 			}
 		}()
 
-		opts.logInfo("copying src file %s to dst file %s", srcFD.Name(), dstFD.Name())
-		if _, err = io.Copy(dstFD, srcFD); err != nil {
+		opts.logInfo("copying src file to dst file", "src", srcFD.Name(), "dst", dstFD.Name())
+		if written, err = io.Copy(dstFD, opts.throttle(srcFD)); err != nil {
 			return err
 		}
 		if err := dstFD.Sync(); err != nil {
 			return err
 		}
-	}
-
-	return setPermissions(dstFile, srcFile.fileInfoOnInit.Mode(), opts)
-}
-
-// backupFile will create a backup of the file using the chosen control method.  See Options.Backup.
-func backupFile(file *File, control string, opts Options) error {
-	// TODO: this func could be more efficient if it used file instead of the path but right now this causes panic
-	// do not copy if the file did not exist
-	if !file.existOnInit {
-		return nil
-	}
-
-	// simple backup
-	simple := func() error {
-		bkp := file.Path + "~"
-		opts.logDebug("creating simple backup file %s", bkp)
-		return Copy(file.Path, bkp, opts)
-	}
-
-	// next gives the next unused backup file number, 1 above the current highest
-	next := func() (int, error) {
-		// find general matches that look like numbered backup files
-		m, err := filepath.Glob(file.Path + ".~[0-9]*~")
-		if err != nil {
-			return -1, err
-		}
-
-		// get each backup file num substring, convert to int, track highest num
-		var highest int
-		for _, f := range m {
-			subs := numberedBackupFile.FindStringSubmatch(filepath.Base(f))
-			if len(subs) > 1 {
-				if i, _ := strconv.Atoi(string(subs[1])); i > highest {
-					highest = i
-				}
-			}
-		}
-		return highest + 1, nil
-	}
-
-	// numbered backup
-	numbered := func(n int) error {
-		return Copy(file.Path, fmt.Sprintf("%s.~%d~", file.Path, n), opts)
-	}
-
-	switch control {
-	default:
-		return errors.Wrapf(ErrInvalidBackupControlValue, "backup value '%s'", control)
-	case "off":
-		return nil
-	case "simple":
-		return simple()
-	case "numbered":
-		i, err := next()
-		if err != nil {
+		if err := syncParent(dstFile.Path, opts); err != nil {
 			return err
 		}
-		return numbered(i)
-	case "existing":
-		i, err := next()
-		if err != nil {
+		if err := setPermissions(dstFD, dstFile, srcFile.fileInfoOnInit.Mode(), opts); err != nil {
 			return err
 		}
-
-		if i > 1 {
-			return numbered(i)
-		}
-		return simple()
 	}
+
+	opts.logInfo("copied file", "src", srcFile.Path, "dst", dstFile.Path, "bytes", written, "elapsed", time.Since(start))
+	opts.Hooks.afterCopy(srcFile.Path, dstFile.Path, written)
+	opts.hardLinks.copied(srcFile.fileInfoOnInit, dstFile.Path)
+	return pruneBackups(dstFile, opts)
 }
 
-func closeAndRemove(file *os.File, logFunc func(format string, a ...interface{})) {
+func closeAndRemove(file *os.File, opts Options) {
 	if file != nil {
 		if err := file.Close(); err != nil {
-			logFunc("err closing file %s: %s", file.Name(), err)
+			opts.logDebug("err closing file", "file", file.Name(), "err", err)
 		}
 		if err := os.Remove(file.Name()); err != nil {
-			logFunc("err removing file %s: %s", file.Name(), err)
+			opts.logDebug("err removing file", "file", file.Name(), "err", err)
 		}
 	}
 }
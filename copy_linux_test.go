@@ -3,10 +3,17 @@
 package flop
 
 import (
+	stderrors "errors"
 	"fmt"
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
 	"io/ioutil"
+	"net"
 	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
 	"testing"
 )
 
@@ -198,3 +205,603 @@ func TestCreatingHardLinksWithLinkOpt(t *testing.T) {
 		})
 	}
 }
+
+func TestAtomicBackupIsHardLink(t *testing.T) {
+	assert := assert.New(t)
+	src, dst := tmpFile(), tmpFile()
+	assert.Nil(ioutil.WriteFile(dst, []byte("old"), 0644))
+	oldInfo, err := os.Stat(dst)
+	assert.Nil(err)
+
+	assert.Nil(Copy(src, dst, Options{Atomic: true, Backup: "simple"}))
+
+	bkpInfo, err := os.Stat(dst + "~")
+	assert.Nil(err)
+	assert.True(os.SameFile(oldInfo, bkpInfo), "backup should be the original dst inode")
+}
+
+func TestConfineTo(t *testing.T) {
+	assert := assert.New(t)
+	tests := []struct {
+		name      string
+		dst       string
+		srcIsDir  bool
+		opts      Options
+		expectErr error
+	}{
+		{name: "inside_root", dst: "a.txt"},
+		{name: "inside_root_atomic", dst: "a.txt", opts: Options{Atomic: true}},
+		{name: "new_dir_inside_root", dst: "new/a.txt", opts: Options{MkdirAll: true}},
+		{name: "dot_dot_escape", dst: "../escaped.txt", expectErr: ErrPathEscapesRoot},
+		{name: "symlinked_parent", dst: "outside/a.txt", expectErr: ErrPathEscapesRoot},
+		{name: "symlinked_parent_atomic", dst: "outside/a.txt", opts: Options{Atomic: true}, expectErr: ErrPathEscapesRoot},
+		{name: "symlinked_dst", dst: "victim.txt", expectErr: ErrPathEscapesRoot},
+		{name: "mkdir_all_through_symlink", dst: "outside/new/a.txt", opts: Options{MkdirAll: true}, expectErr: ErrPathEscapesRoot},
+		{name: "hard_link_through_symlink", dst: "outside/a.txt", opts: Options{Link: true}, expectErr: ErrPathEscapesRoot},
+		{name: "recursive_through_symlink", dst: "outside/tree", srcIsDir: true, opts: Options{Recursive: true}, expectErr: ErrPathEscapesRoot},
+		{name: "backup_through_symlink", dst: "a.txt", opts: Options{Backup: "simple", BackupDir: "outside"}, expectErr: ErrPathEscapesRoot},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			base := tmpDirPath()
+			root, outside := filepath.Join(base, "root"), filepath.Join(base, "outside")
+			assert.Nil(os.Mkdir(root, 0777))
+			assert.Nil(os.Mkdir(outside, 0777))
+			assert.Nil(ioutil.WriteFile(filepath.Join(outside, "victim.txt"), []byte("victim"), 0644))
+			assert.Nil(os.Symlink(outside, filepath.Join(root, "outside")))
+			assert.Nil(os.Symlink(filepath.Join(outside, "victim.txt"), filepath.Join(root, "victim.txt")))
+			assert.Nil(ioutil.WriteFile(filepath.Join(root, "a.txt"), []byte("old"), 0644))
+
+			src := filepath.Join(base, "src")
+			if tt.srcIsDir {
+				assert.Nil(os.MkdirAll(filepath.Join(src, "sub"), 0777))
+				src = filepath.Join(src, "sub", "a.txt")
+			}
+			assert.Nil(ioutil.WriteFile(src, []byte("new"), 0644))
+			if tt.srcIsDir {
+				src = filepath.Join(base, "src")
+			}
+			if tt.opts.BackupDir != "" {
+				tt.opts.BackupDir = filepath.Join(root, tt.opts.BackupDir)
+			}
+			tt.opts.ConfineTo = root
+			tt.opts.InfoLogFunc, tt.opts.DebugLogFunc = infoLogger, debugLogger
+
+			err := Copy(src, filepath.Join(root, filepath.FromSlash(tt.dst)), tt.opts)
+			assert.Equal(tt.expectErr, errors.Cause(err), fmt.Sprintf("%+v", err))
+
+			// nothing outside of root may change
+			assert.Equal(map[string]string{"./": "", "victim.txt": "victim"}, snapshot(outside))
+			_, err = os.Lstat(filepath.Join(base, "escaped.txt"))
+			assert.True(os.IsNotExist(err))
+		})
+	}
+}
+
+func TestConfineDirByPath(t *testing.T) {
+	assert := assert.New(t)
+	root := tmpDirPath()
+	assert.Nil(os.Mkdir(filepath.Join(root, "dir"), 0777))
+	assert.Nil(os.Symlink(os.TempDir(), filepath.Join(root, "link")))
+	opts := Options{ConfineTo: root}
+
+	assert.Nil(confineDirByPath(filepath.Join(root, "dir", "missing", "deeper"), opts))
+	assert.Equal(ErrPathEscapesRoot, errors.Cause(confineDirByPath(filepath.Join(root, "link", "missing"), opts)))
+	assert.Equal(ErrPathEscapesRoot, errors.Cause(confineDirByPath(filepath.Join(root, ".."), opts)))
+}
+
+func TestDstDirCreatesThroughSwappedParent(t *testing.T) {
+	assert := assert.New(t)
+	src := tmpFile()
+	assert.Nil(ioutil.WriteFile(src, []byte("src"), 0644))
+	fifo := filepath.Join(tmpDirPath(), "fifo")
+	assert.Nil(unix.Mkfifo(fifo, 0644))
+	fifoInfo, err := os.Lstat(fifo)
+	assert.Nil(err)
+
+	tests := []struct {
+		name   string
+		create func(dir *dstDir, name string) error
+	}{
+		{name: "mkdir", create: func(dir *dstDir, name string) error { return dir.mkdir(name, 0777) }},
+		{name: "link", create: func(dir *dstDir, name string) error { return dir.link(src, name) }},
+		{name: "symlink", create: func(dir *dstDir, name string) error { return dir.symlink(src, name) }},
+		{name: "mknod", create: func(dir *dstDir, name string) error { return dir.mknod(fifoInfo, name) }},
+		{name: "rename", create: func(dir *dstDir, name string) error {
+			if err := dir.symlink(src, "tmp"); err != nil {
+				return err
+			}
+			return dir.rename("tmp", name)
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			base := tmpDirPath()
+			root, outside := filepath.Join(base, "root"), filepath.Join(base, "outside")
+			assert.Nil(os.MkdirAll(filepath.Join(root, "sub"), 0777))
+			assert.Nil(os.Mkdir(outside, 0777))
+
+			dir, err := openDstDir(filepath.Join(root, "sub"), Options{ConfineTo: root})
+			assert.Nil(err)
+			defer dir.close()
+			// swap the opened directory for a symbolic link out of root
+			assert.Nil(os.Rename(filepath.Join(root, "sub"), filepath.Join(root, "moved")))
+			assert.Nil(os.Symlink(outside, filepath.Join(root, "sub")))
+
+			assert.Nil(tt.create(dir, "new"))
+			assert.Equal(map[string]string{"./": ""}, snapshot(outside))
+			_, err = os.Lstat(filepath.Join(root, "moved", "new"))
+			assert.Nil(err, "entry should be created in the opened directory")
+		})
+	}
+}
+
+func TestMkdirBeneath(t *testing.T) {
+	assert := assert.New(t)
+	base := tmpDirPath()
+	root, outside := filepath.Join(base, "root"), filepath.Join(base, "outside")
+	assert.Nil(os.Mkdir(root, 0777))
+	assert.Nil(os.Mkdir(outside, 0777))
+	opts := Options{ConfineTo: root}
+
+	missing := []string{filepath.Join(root, "a"), filepath.Join(root, "a", "b")}
+	created, err := mkdirBeneath(missing, 0777, opts)
+	assert.Nil(err)
+	assert.Equal(missing, created)
+	info, err := os.Stat(filepath.Join(root, "a", "b"))
+	assert.Nil(err)
+	assert.True(info.IsDir())
+
+	// a parent swapped for a symbolic link after the missing directories were found
+	assert.Nil(os.Symlink(outside, filepath.Join(root, "link")))
+	created, err = mkdirBeneath([]string{filepath.Join(root, "link", "new")}, 0777, opts)
+	assert.Equal(ErrPathEscapesRoot, errors.Cause(err), fmt.Sprintf("%+v", err))
+	assert.Empty(created)
+	assert.Equal(map[string]string{"./": ""}, snapshot(outside))
+}
+
+func TestCopyFileDetectsSwaps(t *testing.T) {
+	assert := assert.New(t)
+	tests := []struct {
+		name   string
+		atomic bool
+		// swap changes the tree after src and dst are stat'ed and before they are used.  Replacements are
+		// renamed into place so they cannot reuse the inode of the file they replace.
+		swap func(src, dst, victim string) error
+		// renamed is called in place of rename, nil uses os.Rename
+		renamed func(oldpath, newpath string) error
+	}{
+		{
+			name: "src_replaced",
+			swap: func(src, dst, victim string) error {
+				if err := ioutil.WriteFile(src+".new", []byte("other"), 0644); err != nil {
+					return err
+				}
+				return os.Rename(src+".new", src)
+			},
+		},
+		{
+			name: "dst_replaced_with_symlink",
+			swap: func(src, dst, victim string) error {
+				if err := os.Symlink(victim, dst+".new"); err != nil {
+					return err
+				}
+				return os.Rename(dst+".new", dst)
+			},
+		},
+		{
+			name:   "dst_replaced_with_symlink_atomic",
+			atomic: true,
+			swap: func(src, dst, victim string) error {
+				if err := os.Symlink(victim, dst+".new"); err != nil {
+					return err
+				}
+				return os.Rename(dst+".new", dst)
+			},
+		},
+		{
+			name: "dst_replaced_with_other_file",
+			swap: func(src, dst, victim string) error {
+				if err := os.Link(victim, dst+".new"); err != nil {
+					return err
+				}
+				return os.Rename(dst+".new", dst)
+			},
+		},
+		{
+			name:   "dir_replaced_before_rename",
+			atomic: true,
+			renamed: func(oldpath, newpath string) error {
+				// move the directory aside, put a new one in its place and move tmp into it
+				dir := filepath.Dir(newpath)
+				if err := os.Rename(dir, dir+".aside"); err != nil {
+					return err
+				}
+				if err := os.Mkdir(dir, 0777); err != nil {
+					return err
+				}
+				if err := os.Rename(filepath.Join(dir+".aside", filepath.Base(oldpath)), oldpath); err != nil {
+					return err
+				}
+				return os.Rename(oldpath, newpath)
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			base := tmpDirPath()
+			src, victim := filepath.Join(base, "src.txt"), filepath.Join(base, "victim.txt")
+			dst := filepath.Join(base, "dir", "dst.txt")
+			assert.Nil(os.Mkdir(filepath.Dir(dst), 0777))
+			assert.Nil(ioutil.WriteFile(src, []byte("new"), 0644))
+			assert.Nil(ioutil.WriteFile(dst, []byte("old"), 0644))
+			assert.Nil(ioutil.WriteFile(victim, []byte("victim"), 0644))
+
+			srcFile, dstFile := NewFile(src), NewFile(dst)
+			assert.Nil(srcFile.setInfo())
+			assert.Nil(dstFile.setInfo())
+			if tt.swap != nil {
+				assert.Nil(tt.swap(src, dst, victim))
+			}
+			if tt.renamed != nil {
+				rename = tt.renamed
+				defer func() { rename = os.Rename }()
+			}
+
+			opts := Options{Atomic: tt.atomic}
+			opts.setLoggers()
+			err := copyFile(srcFile, dstFile, opts)
+			assert.Equal(ErrFileChanged, errors.Cause(err), fmt.Sprintf("%+v", err))
+
+			b, err := ioutil.ReadFile(victim)
+			assert.Nil(err)
+			assert.Equal([]byte("victim"), b)
+		})
+	}
+}
+
+func TestPreserveHardLinks(t *testing.T) {
+	assert := assert.New(t)
+	tests := []struct {
+		name       string
+		opts       Options
+		dstExists  bool
+		expectSame bool
+	}{
+		{name: "independent_copies_by_default", opts: Options{Recursive: true}},
+		{name: "preserved", opts: Options{Recursive: true, PreserveHardLinks: true}, expectSame: true},
+		{name: "preserved_over_existing_dst", opts: Options{Recursive: true, PreserveHardLinks: true}, dstExists: true, expectSame: true},
+		{name: "preserved_atomic_tree", opts: Options{Recursive: true, PreserveHardLinks: true, AtomicTree: true}, expectSame: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src, dst := tmpDirPath(), tmpDirPathUnused()
+			assert.Nil(os.Mkdir(filepath.Join(src, "sub"), 0777))
+			assert.Nil(ioutil.WriteFile(filepath.Join(src, "a.txt"), []byte("shared"), 0644))
+			assert.Nil(os.Link(filepath.Join(src, "a.txt"), filepath.Join(src, "sub", "b.txt")))
+			assert.Nil(ioutil.WriteFile(filepath.Join(src, "c.txt"), []byte("shared"), 0644))
+			if tt.dstExists {
+				assert.Nil(os.MkdirAll(filepath.Join(dst, "sub"), 0777))
+				assert.Nil(ioutil.WriteFile(filepath.Join(dst, "sub", "b.txt"), []byte("old"), 0644))
+			}
+
+			assert.Nil(Copy(src, dst, tt.opts))
+
+			a, err := os.Stat(filepath.Join(dst, "a.txt"))
+			assert.Nil(err)
+			b, err := os.Stat(filepath.Join(dst, "sub", "b.txt"))
+			assert.Nil(err)
+			c, err := os.Stat(filepath.Join(dst, "c.txt"))
+			assert.Nil(err)
+			assert.Equal(tt.expectSame, os.SameFile(a, b))
+			assert.False(os.SameFile(a, c))
+			content, err := ioutil.ReadFile(filepath.Join(dst, "sub", "b.txt"))
+			assert.Nil(err)
+			assert.Equal([]byte("shared"), content)
+		})
+	}
+}
+
+func TestLinkToCopyErrors(t *testing.T) {
+	assert := assert.New(t)
+	for _, dstExists := range []bool{false, true} {
+		dir := tmpDirPath()
+		dst := filepath.Join(dir, "dst.txt")
+		if dstExists {
+			assert.Nil(ioutil.WriteFile(dst, []byte("old"), 0644))
+		}
+
+		err := linkToCopy(filepath.Join(dir, "missing.txt"), dst, nil, Options{})
+		assert.True(stderrors.Is(err, ErrCannotOpenOrCreateDstFile), fmt.Sprintf("dst exists %v: %+v", dstExists, err))
+		var flopErr *Error
+		assert.True(stderrors.As(err, &flopErr))
+	}
+}
+
+func TestPreserveHardLinksSkippedFirstCopy(t *testing.T) {
+	assert := assert.New(t)
+	tests := []struct {
+		name string
+		opts Options
+	}{
+		{"no_clobber", Options{NoClobber: true}},
+		{"conflict_skip", Options{OnConflict: func(src, dst os.FileInfo) (Decision, error) { return Skip, nil }}},
+		{"conflict_rename_new", Options{OnConflict: func(src, dst os.FileInfo) (Decision, error) { return RenameNew, nil }}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src, dst := tmpDirPath(), tmpDirPath()
+			assert.Nil(ioutil.WriteFile(filepath.Join(src, "a"), []byte("shared"), 0644))
+			assert.Nil(os.Link(filepath.Join(src, "a"), filepath.Join(src, "b")))
+			assert.Nil(ioutil.WriteFile(filepath.Join(dst, "a"), []byte("unrelated"), 0644))
+
+			tt.opts.Recursive, tt.opts.PreserveHardLinks = true, true
+			assert.Nil(Copy(src, dst, tt.opts))
+
+			content, err := ioutil.ReadFile(filepath.Join(dst, "a"))
+			assert.Nil(err)
+			assert.Equal([]byte("unrelated"), content)
+			content, err = ioutil.ReadFile(filepath.Join(dst, "b"))
+			assert.Nil(err)
+			assert.Equal([]byte("shared"), content)
+		})
+	}
+}
+
+func TestCopySpecialFiles(t *testing.T) {
+	assert := assert.New(t)
+	src := tmpDirPath()
+	fifo, sock := filepath.Join(src, "fifo"), filepath.Join(src, "sock")
+	assert.Nil(unix.Mkfifo(fifo, 0640))
+	l, err := net.Listen("unix", sock)
+	assert.Nil(err)
+	defer l.Close()
+	assert.Nil(ioutil.WriteFile(filepath.Join(src, "file.txt"), []byte("foo"), 0644))
+
+	tests := []struct {
+		name       string
+		src        string
+		opts       Options
+		expectErr  error
+		expectMode os.FileMode
+		root       bool
+	}{
+		{name: "fifo_without_copy_special", src: fifo, expectErr: ErrSpecialFile},
+		{name: "fifo", src: fifo, opts: Options{CopySpecial: true}, expectMode: os.ModeNamedPipe},
+		{name: "socket", src: sock, opts: Options{CopySpecial: true}, expectMode: os.ModeSocket},
+		{name: "char_device", src: "/dev/null", opts: Options{CopySpecial: true}, expectMode: os.ModeDevice | os.ModeCharDevice, root: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.root && os.Geteuid() != 0 {
+				t.Skip("creating device nodes requires root")
+			}
+			dst := tmpFilePathUnused()
+			err := Copy(tt.src, dst, tt.opts)
+			assert.Equal(tt.expectErr, errors.Cause(err))
+			if tt.expectErr != nil {
+				return
+			}
+			srcInfo, err := os.Lstat(tt.src)
+			assert.Nil(err)
+			dstInfo, err := os.Lstat(dst)
+			assert.Nil(err)
+			assert.Equal(tt.expectMode, dstInfo.Mode()&specialModes)
+			if tt.root {
+				assert.Equal(srcInfo.Sys().(*syscall.Stat_t).Rdev, dstInfo.Sys().(*syscall.Stat_t).Rdev)
+			}
+
+			// replacing an existing special file goes through a rename
+			assert.Nil(Copy(tt.src, dst, tt.opts))
+		})
+	}
+
+	t.Run("skipped_in_tree", func(t *testing.T) {
+		dst := tmpDirPathUnused()
+		assert.Nil(Copy(src, dst, Options{Recursive: true}))
+		assert.Equal(map[string]string{"./": "", "file.txt": "foo"}, snapshot(dst))
+	})
+}
+
+func TestOnConflictForHardLinksAndSpecialFiles(t *testing.T) {
+	assert := assert.New(t)
+	tests := []struct {
+		decision  Decision
+		expectErr error
+		// expectDst is true if dst is replaced
+		expectDst bool
+		expectNew bool
+		expectBkp bool
+	}{
+		{decision: Skip},
+		{decision: Abort, expectErr: ErrConflictAborted},
+		{decision: RenameNew, expectNew: true},
+		{decision: BackupThenOverwrite, expectDst: true, expectBkp: true},
+	}
+	for _, special := range []bool{false, true} {
+		for _, tt := range tests {
+			name := fmt.Sprintf("%s_hard_link", tt.decision)
+			if special {
+				name = fmt.Sprintf("%s_special_file", tt.decision)
+			}
+			t.Run(name, func(t *testing.T) {
+				src, dir := tmpDirPath(), tmpDirPath()
+				dst := filepath.Join(dir, "b")
+				assert.Nil(ioutil.WriteFile(dst, []byte("keep me"), 0644))
+				asked := 0
+				opts := Options{OnConflict: func(src, dst os.FileInfo) (Decision, error) {
+					asked++
+					return tt.decision, nil
+				}}
+				if special {
+					assert.Nil(unix.Mkfifo(filepath.Join(src, "b"), 0644))
+					opts.CopySpecial = true
+					src = filepath.Join(src, "b")
+				} else {
+					assert.Nil(ioutil.WriteFile(filepath.Join(src, "a"), []byte("x"), 0644))
+					assert.Nil(os.Link(filepath.Join(src, "a"), filepath.Join(src, "b")))
+					opts.Recursive, opts.PreserveHardLinks = true, true
+					dst = dir
+				}
+
+				err := Copy(src, dst, opts)
+				assert.Equal(tt.expectErr, errors.Cause(err))
+				assert.Equal(1, asked, "OnConflict should be asked about the existing dst")
+				info, err := os.Lstat(filepath.Join(dir, "b"))
+				assert.Nil(err)
+				replaced := info.Mode()&os.ModeNamedPipe != 0
+				if !special {
+					b, _ := ioutil.ReadFile(filepath.Join(dir, "b"))
+					replaced = string(b) == "x"
+				}
+				assert.Equal(tt.expectDst, replaced)
+				_, err = os.Lstat(filepath.Join(dir, "b-1"))
+				assert.Equal(tt.expectNew, err == nil)
+				_, err = os.Lstat(filepath.Join(dir, "b~"))
+				assert.Equal(tt.expectBkp, err == nil)
+			})
+		}
+	}
+}
+
+func TestHooksReportEveryEntry(t *testing.T) {
+	assert := assert.New(t)
+	src, dst := tmpDirPath(), tmpDirPathUnused()
+	a, b, l, p := filepath.Join(src, "a"), filepath.Join(src, "b"), filepath.Join(src, "l"), filepath.Join(src, "p")
+	assert.Nil(ioutil.WriteFile(a, []byte("a"), 0644))
+	assert.Nil(os.Link(a, b))
+	assert.Nil(os.Symlink("a", l))
+	assert.Nil(unix.Mkfifo(p, 0644))
+
+	var events []string
+	opts := Options{Recursive: true, MkdirAll: true, PreserveHardLinks: true, CopySpecial: true, Hooks: hookRecorder(&events)}
+	result, err := CopyWithResult(src, dst, opts)
+	assert.Nil(err)
+
+	var changes []string
+	for _, event := range events {
+		if !strings.HasPrefix(event, "chmod ") {
+			changes = append(changes, event)
+		}
+	}
+	assert.Equal([]string{
+		"mkdir " + dst,
+		"before copy " + a + " " + filepath.Join(dst, "a"),
+		"after copy " + a + " " + filepath.Join(dst, "a") + " 1",
+		"before copy " + filepath.Join(dst, "a") + " " + filepath.Join(dst, "b"),
+		"link " + filepath.Join(dst, "a") + " " + filepath.Join(dst, "b"),
+		"before copy " + l + " " + filepath.Join(dst, "l"),
+		"symlink " + l + " " + filepath.Join(dst, "l") + " a",
+		"before copy " + p + " " + filepath.Join(dst, "p"),
+		"special " + p + " " + filepath.Join(dst, "p"),
+	}, changes)
+	assert.Equal(1, result.Copied)
+	assert.Equal(1, result.Linked)
+	assert.Equal(1, result.Symlinked)
+	assert.Equal(1, result.Special)
+}
+
+func TestBeforeCopyVetoesEveryEntry(t *testing.T) {
+	assert := assert.New(t)
+	errVeto := errors.New("vetoed")
+	tests := []struct {
+		name string
+		// setup creates the source in dir and returns it
+		setup func(dir string) string
+		opts  Options
+	}{
+		{
+			name: "link",
+			setup: func(dir string) string {
+				assert.Nil(ioutil.WriteFile(filepath.Join(dir, "src"), []byte("a"), 0644))
+				return filepath.Join(dir, "src")
+			},
+			opts: Options{Link: true},
+		},
+		{
+			name: "symlink",
+			setup: func(dir string) string {
+				assert.Nil(os.Symlink("target", filepath.Join(dir, "src")))
+				return filepath.Join(dir, "src")
+			},
+		},
+		{
+			name: "special",
+			setup: func(dir string) string {
+				assert.Nil(unix.Mkfifo(filepath.Join(dir, "src"), 0644))
+				return filepath.Join(dir, "src")
+			},
+			opts: Options{CopySpecial: true},
+		},
+		{
+			name: "preserved_hard_link",
+			setup: func(dir string) string {
+				src := filepath.Join(dir, "src")
+				assert.Nil(os.Mkdir(src, 0777))
+				assert.Nil(ioutil.WriteFile(filepath.Join(src, "a"), []byte("a"), 0644))
+				assert.Nil(os.Link(filepath.Join(src, "a"), filepath.Join(src, "dst")))
+				return src
+			},
+			opts: Options{Recursive: true, PreserveHardLinks: true},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src := tt.setup(tmpDirPath())
+			dstDir := tmpDirPath()
+			dst := filepath.Join(dstDir, "dst")
+			if tt.opts.Recursive {
+				dst = dstDir
+			}
+			tt.opts.Hooks.BeforeCopy = func(src, dst string) error {
+				if filepath.Base(dst) == "dst" {
+					return errVeto
+				}
+				return nil
+			}
+
+			assert.Equal(errVeto, Copy(src, dst, tt.opts))
+			_, err := os.Lstat(filepath.Join(dstDir, "dst"))
+			assert.True(os.IsNotExist(err), "a vetoed entry should not be created")
+		})
+	}
+}
+
+func TestSyncSymbolicLinks(t *testing.T) {
+	assert := assert.New(t)
+	src, dst := tmpDirPath(), tmpDirPath()
+	assert.Nil(os.Symlink("a.txt", filepath.Join(src, "same")))
+	assert.Nil(os.Symlink("a.txt", filepath.Join(dst, "same")))
+	assert.Nil(os.Symlink("a.txt", filepath.Join(src, "changed")))
+	assert.Nil(os.Symlink("b.txt", filepath.Join(dst, "changed")))
+	assert.Nil(os.Symlink("a.txt", filepath.Join(src, "new")))
+
+	report, err := Sync(src, dst, SyncOptions{})
+	assert.Nil(err)
+	assert.Equal(SyncReport{Created: []string{"new"}, Updated: []string{"changed"}}, report)
+	for _, name := range []string{"same", "changed", "new"} {
+		link, err := os.Readlink(filepath.Join(dst, name))
+		assert.Nil(err)
+		assert.Equal("a.txt", link)
+	}
+}
+
+func TestDiffSymbolicLinks(t *testing.T) {
+	assert := assert.New(t)
+	a, b := tmpDirPath(), tmpDirPath()
+	for _, dir := range []string{a, b} {
+		assert.Nil(ioutil.WriteFile(filepath.Join(dir, "a.txt"), []byte("a"), 0644))
+		assert.Nil(os.Symlink("a.txt", filepath.Join(dir, "same")))
+	}
+	assert.Nil(os.Symlink("a.txt", filepath.Join(a, "changed")))
+	assert.Nil(os.Symlink("b.txt", filepath.Join(b, "changed")))
+	assert.Nil(os.Symlink("a.txt", filepath.Join(a, "replaced")))
+	assert.Nil(ioutil.WriteFile(filepath.Join(b, "replaced"), []byte("a"), 0644))
+
+	report, err := Diff(a, b, DiffOptions{IgnoreModTime: true})
+	assert.Nil(err)
+	assert.Equal(DiffReport{
+		{Path: "changed", Type: Modified, Changes: []string{"target"}},
+		{Path: "replaced", Type: TypeChanged, From: "symlink", To: "file"},
+	}, report)
+}
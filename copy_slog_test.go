@@ -0,0 +1,26 @@
+// +build go1.21
+
+package flop
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSlogLogger(t *testing.T) {
+	assert := assert.New(t)
+	var buf bytes.Buffer
+	logger := NewSlogLogger(slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug})))
+	logger.Debug("copied file", "src", "/a", "bytes", int64(3))
+
+	var record map[string]interface{}
+	assert.Nil(json.Unmarshal(buf.Bytes(), &record))
+	assert.Equal("DEBUG", record["level"])
+	assert.Equal("copied file", record["msg"])
+	assert.Equal("/a", record["src"])
+	assert.Equal(float64(3), record["bytes"])
+}
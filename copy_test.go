@@ -1,12 +1,21 @@
 package flop
 
 import (
+	"bytes"
+	"encoding/json"
+	stderrors "errors"
 	"fmt"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
 	"github.com/stretchr/testify/assert"
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"runtime"
+	"strings"
 	"testing"
+	"time"
 )
 
 // debug will perform advanced logging if set to true
@@ -542,3 +551,1854 @@ func TestCreatingNumberedBackupFilesWhenBackupFilesAreNumbered(t *testing.T) {
 		})
 	}
 }
+
+func TestCopyMany(t *testing.T) {
+	assert := assert.New(t)
+	content := []byte("foo")
+
+	tests := []struct {
+		name string
+		// srcs is the number of source files to create
+		srcs                 int
+		dstIsDir             bool
+		options              Options
+		errExpected          error
+		expectInsideDstDir   bool
+		expectDstFileContent bool
+	}{
+		{name: "multiple_srcs_into_dir", srcs: 3, dstIsDir: true, expectInsideDstDir: true},
+		{name: "single_src_into_dir", srcs: 1, dstIsDir: true, expectInsideDstDir: true},
+		{name: "single_src_to_file", srcs: 1, expectDstFileContent: true},
+		{name: "multiple_srcs_to_file", srcs: 2, errExpected: ErrTargetNotDir},
+		{name: "target_directory_with_file", srcs: 1, options: Options{TargetDirectory: true}, errExpected: ErrTargetNotDir},
+		{name: "no_target_directory_to_file", srcs: 1, options: Options{NoTargetDirectory: true}, expectDstFileContent: true},
+		{name: "no_target_directory_with_dir", srcs: 1, dstIsDir: true, options: Options{NoTargetDirectory: true}, errExpected: ErrWritingFileToExistingDir},
+		{name: "no_target_directory_multiple_srcs", srcs: 2, dstIsDir: true, options: Options{NoTargetDirectory: true}, errExpected: ErrTooManySrcs},
+		{name: "conflicting_target_options", srcs: 1, dstIsDir: true, options: Options{TargetDirectory: true, NoTargetDirectory: true}, errExpected: ErrTargetDirectoryConflict},
+		{name: "no_srcs", dstIsDir: true, errExpected: ErrMissingSrc},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var srcs []string
+			for i := 0; i < tt.srcs; i++ {
+				src := tmpFile()
+				assert.Nil(ioutil.WriteFile(src, content, 0655))
+				srcs = append(srcs, src)
+			}
+			dst := tmpFile()
+			if tt.dstIsDir {
+				dst = tmpDirPathUnused()
+				assert.Nil(os.MkdirAll(dst, 0777))
+			}
+
+			err := CopyMany(srcs, dst, tt.options)
+			if tt.errExpected != nil {
+				assert.Equal(tt.errExpected, errors.Cause(err))
+				return
+			}
+			assert.Nil(err)
+			for _, src := range srcs {
+				if tt.expectInsideDstDir {
+					b, err := ioutil.ReadFile(filepath.Join(dst, filepath.Base(src)))
+					assert.Nil(err)
+					assert.Equal(content, b)
+				}
+			}
+			if tt.expectDstFileContent {
+				b, err := ioutil.ReadFile(dst)
+				assert.Nil(err)
+				assert.Equal(content, b)
+			}
+		})
+	}
+}
+
+func TestCopyManyCopiesDirsIntoDstDir(t *testing.T) {
+	assert := assert.New(t)
+	src, dst := tmpDirPath(), tmpDirPath()
+	content := []byte("foo")
+	assert.Nil(ioutil.WriteFile(filepath.Join(src, "file.txt"), content, 0655))
+
+	assert.Nil(CopyMany([]string{src}, dst, Options{Recursive: true}))
+	b, err := ioutil.ReadFile(filepath.Join(dst, filepath.Base(src), "file.txt"))
+	assert.Nil(err)
+	assert.Equal(content, b)
+}
+
+func TestBackupSuffixAndEnv(t *testing.T) {
+	assert := assert.New(t)
+	tests := []struct {
+		name              string
+		opts              Options
+		env               map[string]string
+		expectedBkpSuffix string
+	}{
+		{"custom_suffix", Options{Backup: "simple", BackupSuffix: ".bak"}, nil, ".bak"},
+		{"alias_never", Options{Backup: "never"}, nil, "~"},
+		{"alias_t", Options{Backup: "t"}, nil, ".~1~"},
+		{"env_ignored_without_opt_in", Options{Backup: "simple"}, map[string]string{"SIMPLE_BACKUP_SUFFIX": ".env"}, "~"},
+		{"env_suffix", Options{Backup: "simple", BackupEnv: true}, map[string]string{"SIMPLE_BACKUP_SUFFIX": ".env"}, ".env"},
+		{"suffix_option_beats_env", Options{Backup: "simple", BackupSuffix: ".opt", BackupEnv: true}, map[string]string{"SIMPLE_BACKUP_SUFFIX": ".env"}, ".opt"},
+		{"env_version_control", Options{Backup: "env", BackupEnv: true}, map[string]string{"VERSION_CONTROL": "numbered"}, ".~1~"},
+		{"env_version_control_default", Options{Backup: "env", BackupEnv: true}, nil, "~"},
+		{"env_control_without_opt_in", Options{Backup: "env"}, map[string]string{"VERSION_CONTROL": "numbered"}, "~"},
+		{"env_alone_makes_no_backup", Options{BackupEnv: true}, map[string]string{"VERSION_CONTROL": "numbered"}, ""},
+		{"backup_option_beats_env", Options{Backup: "simple", BackupEnv: true}, map[string]string{"VERSION_CONTROL": "numbered"}, "~"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, k := range []string{"SIMPLE_BACKUP_SUFFIX", "VERSION_CONTROL"} {
+				old, ok := os.LookupEnv(k)
+				if v, set := tt.env[k]; set {
+					assert.Nil(os.Setenv(k, v))
+				} else {
+					assert.Nil(os.Unsetenv(k))
+				}
+				if ok {
+					defer os.Setenv(k, old)
+				} else {
+					defer os.Unsetenv(k)
+				}
+			}
+
+			src, dst := tmpFile(), tmpFile()
+			content := []byte("foo")
+			assert.Nil(ioutil.WriteFile(dst, content, 0655))
+
+			assert.Nil(Copy(src, dst, tt.opts))
+			if tt.expectedBkpSuffix == "" {
+				backups, err := ListBackups(dst, tt.opts)
+				assert.Nil(err)
+				assert.Empty(backups)
+				return
+			}
+			b, err := ioutil.ReadFile(dst + tt.expectedBkpSuffix)
+			assert.Nil(err)
+			assert.Equal(content, b)
+		})
+	}
+}
+
+func TestBackupNoneAliasMakesNoBackup(t *testing.T) {
+	assert := assert.New(t)
+	src, dst := tmpFile(), tmpFile()
+	assert.Nil(Copy(src, dst, Options{Backup: "none"}))
+	_, err := os.Stat(dst + "~")
+	assert.True(os.IsNotExist(err))
+}
+
+// oneObjectStore is an ObjectStore holding a single object, whose download fails part way through if fail is
+// true.
+type oneObjectStore struct {
+	ObjectStore
+	key, content string
+	fail         bool
+}
+
+func (s oneObjectStore) ListObjects(prefix string) ([]ObjectInfo, error) {
+	return []ObjectInfo{{Key: s.key, Size: int64(len(s.content))}}, nil
+}
+
+func (s oneObjectStore) GetObject(key string) (io.ReadCloser, error) {
+	var r io.Reader = strings.NewReader(s.content)
+	if s.fail {
+		r = io.MultiReader(r, failingReader{})
+	}
+	return ioutil.NopCloser(r), nil
+}
+
+// failingReader always fails to read.
+type failingReader struct{}
+
+func (failingReader) Read([]byte) (int, error) {
+	return 0, stderrors.New("simulated read failure")
+}
+
+func TestFailedAtomicDownloadMakesNoBackup(t *testing.T) {
+	assert := assert.New(t)
+	dst := tmpFile()
+	assert.Nil(ioutil.WriteFile(dst, []byte("old"), 0644))
+	opts := Options{Atomic: true, Backup: "simple", ObjectStores: map[string]ObjectStore{"bucket": oneObjectStore{key: "f", content: "partial", fail: true}}}
+
+	assert.NotNil(Copy("s3://bucket/f", dst, opts))
+	b, err := ioutil.ReadFile(dst)
+	assert.Nil(err)
+	assert.Equal("old", string(b))
+	_, err = os.Lstat(dst + "~")
+	assert.True(os.IsNotExist(err), "no backup should be made when nothing replaced dst")
+}
+
+func TestBackupDirMirrorsDstTree(t *testing.T) {
+	assert := assert.New(t)
+	src, dst, bkpDir := tmpDirPath(), tmpDirPath(), tmpDirPathUnused()
+	assert.Nil(os.MkdirAll(filepath.Join(src, "sub"), 0777))
+	assert.Nil(os.MkdirAll(filepath.Join(dst, "sub"), 0777))
+	assert.Nil(ioutil.WriteFile(filepath.Join(src, "sub", "file.txt"), []byte("new"), 0655))
+	assert.Nil(ioutil.WriteFile(filepath.Join(dst, "sub", "file.txt"), []byte("old"), 0655))
+
+	assert.Nil(Copy(src, dst, Options{Recursive: true, Backup: "numbered", BackupDir: bkpDir}))
+
+	b, err := ioutil.ReadFile(filepath.Join(bkpDir, "sub", "file.txt.~1~"))
+	assert.Nil(err)
+	assert.Equal([]byte("old"), b)
+	_, err = os.Stat(filepath.Join(dst, "sub", "file.txt.~1~"))
+	assert.True(os.IsNotExist(err), "backup should not be next to the dst file")
+}
+
+func TestBackupRetention(t *testing.T) {
+	assert := assert.New(t)
+	tests := []struct {
+		name      string
+		retain    Retention
+		oldAge    time.Duration
+		expectNum []int
+	}{
+		{"keep_everything", Retention{}, 0, []int{1, 2, 3, 4}},
+		{"keep_newest_two", Retention{Count: 2}, 0, []int{3, 4}},
+		{"keep_younger_than_an_hour", Retention{MaxAge: time.Hour}, 2 * time.Hour, []int{4}},
+		{"count_and_age", Retention{Count: 3, MaxAge: time.Hour}, 2 * time.Hour, []int{4}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src, dst := tmpFile(), tmpFile()
+			for _, num := range []int{1, 2, 3} {
+				numberedFile := fmt.Sprintf("%s.~%d~", dst, num)
+				assert.Nil(ioutil.WriteFile(numberedFile, []byte("foo"), 0655))
+				old := time.Now().Add(-tt.oldAge)
+				assert.Nil(os.Chtimes(numberedFile, old, old))
+			}
+
+			assert.Nil(Copy(src, dst, Options{Backup: "numbered", BackupRetain: tt.retain}))
+
+			var found []int
+			for num := 1; num <= 4; num++ {
+				if _, err := os.Stat(fmt.Sprintf("%s.~%d~", dst, num)); err == nil {
+					found = append(found, num)
+				}
+			}
+			assert.Equal(tt.expectNum, found)
+		})
+	}
+}
+
+func TestBackupRetentionWithoutVersionedBackups(t *testing.T) {
+	assert := assert.New(t)
+	for _, control := range []string{"", "off", "none", "never", "simple"} {
+		t.Run(control, func(t *testing.T) {
+			src, dst := tmpFile(), tmpFile()
+			for _, num := range []int{1, 2} {
+				assert.Nil(ioutil.WriteFile(fmt.Sprintf("%s.~%d~", dst, num), []byte("foo"), 0655))
+			}
+
+			assert.Nil(Copy(src, dst, Options{Backup: control, BackupRetain: Retention{Count: 1}}))
+			for _, num := range []int{1, 2} {
+				_, err := os.Stat(fmt.Sprintf("%s.~%d~", dst, num))
+				assert.Nil(err, "backup %d should be kept", num)
+			}
+		})
+	}
+}
+
+func TestBackupRetentionKeepsNewBackupOfOldFile(t *testing.T) {
+	assert := assert.New(t)
+	tests := []struct {
+		name   string
+		opts   Options
+		backup string
+	}{
+		{"atomic_numbered", Options{Atomic: true, Backup: "numbered"}, ".~1~"},
+		{"numbered", Options{Backup: "numbered"}, ".~1~"},
+		{"atomic_timestamp", Options{Atomic: true, Backup: "timestamp", BackupTimeLayout: "2006"}, ".~" + time.Now().UTC().Format("2006") + "~"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src, dst := tmpFile(), tmpFile()
+			assert.Nil(ioutil.WriteFile(dst, []byte("old"), 0644))
+			old := time.Now().Add(-48 * time.Hour)
+			assert.Nil(os.Chtimes(dst, old, old))
+
+			tt.opts.BackupRetain = Retention{MaxAge: time.Hour}
+			assert.Nil(Copy(src, dst, tt.opts))
+			b, err := ioutil.ReadFile(dst + tt.backup)
+			assert.Nil(err)
+			assert.Equal("old", string(b))
+		})
+	}
+}
+
+func TestCreatingTimestampedBackupFile(t *testing.T) {
+	assert := assert.New(t)
+	tests := []struct {
+		name   string
+		layout string
+	}{
+		{"default_layout", ""},
+		{"custom_layout", "2006-01-02_15.04.05"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src, dst := tmpFile(), tmpFile()
+			content := []byte("foo")
+			assert.Nil(ioutil.WriteFile(dst, content, 0655))
+
+			before := time.Now().UTC().Truncate(time.Second)
+			assert.Nil(Copy(src, dst, Options{Backup: "timestamp", BackupTimeLayout: tt.layout}))
+
+			layout := tt.layout
+			if layout == "" {
+				layout = "20060102T150405Z"
+			}
+			backups, err := versionedBackups(dst, layout)
+			assert.Nil(err)
+			if assert.Len(backups, 1) {
+				assert.False(backups[0].Time.Before(before))
+				b, err := ioutil.ReadFile(backups[0].Path)
+				assert.Nil(err)
+				assert.Equal(content, b)
+			}
+		})
+	}
+}
+
+func TestTimestampedBackupsInTheSameSecondAreKept(t *testing.T) {
+	assert := assert.New(t)
+	for _, atomic := range []bool{false, true} {
+		src, dst := tmpFile(), tmpFile()
+		opts := Options{Backup: "timestamp", BackupTimeLayout: "2006", Atomic: atomic}
+		for _, content := range []string{"v1", "v2", "v3"} {
+			assert.Nil(ioutil.WriteFile(dst, []byte(content), 0644))
+			assert.Nil(Copy(src, dst, opts))
+		}
+
+		backups, err := ListBackups(dst, opts)
+		assert.Nil(err)
+		var contents []string
+		for _, bkp := range backups {
+			b, err := ioutil.ReadFile(bkp.Path)
+			assert.Nil(err)
+			contents = append(contents, string(b))
+		}
+		assert.Equal([]string{"v1", "v2", "v3"}, contents)
+		if assert.Len(backups, 3) {
+			year := time.Now().UTC().Format("2006")
+			assert.Equal(dst+".~"+year+"-2~", backups[2].Path)
+		}
+	}
+}
+
+func TestExistingBackupRecognizesTimestampedBackups(t *testing.T) {
+	assert := assert.New(t)
+	src, dst := tmpFile(), tmpFile()
+	assert.Nil(ioutil.WriteFile(dst+".~20200101T000000Z~", []byte("old"), 0655))
+
+	assert.Nil(Copy(src, dst, Options{Backup: "existing"}))
+
+	backups, err := versionedBackups(dst, "20060102T150405Z")
+	assert.Nil(err)
+	assert.Len(backups, 2)
+	_, err = os.Stat(dst + "~")
+	assert.True(os.IsNotExist(err), "a simple backup should not be made")
+}
+
+func TestVersionedBackupsSortOldestFirst(t *testing.T) {
+	assert := assert.New(t)
+	dst := tmpFile()
+	for _, suffix := range []string{".~20200102T000000Z~", ".~10~", ".~20200101T000000Z~", ".~2~", "~", ".~bogus~"} {
+		assert.Nil(ioutil.WriteFile(dst+suffix, []byte("foo"), 0655))
+	}
+
+	backups, err := versionedBackups(dst, "20060102T150405Z")
+	assert.Nil(err)
+	var paths []string
+	for _, bkp := range backups {
+		paths = append(paths, strings.TrimPrefix(bkp.Path, dst))
+	}
+	assert.Equal([]string{".~2~", ".~10~", ".~20200101T000000Z~", ".~20200102T000000Z~"}, paths)
+}
+
+func TestListBackups(t *testing.T) {
+	assert := assert.New(t)
+	dst := tmpFile()
+	for _, suffix := range []string{".~20200101T000000Z~", ".~3~", "~", ".~1~"} {
+		assert.Nil(ioutil.WriteFile(dst+suffix, []byte("foo"), 0655))
+	}
+
+	backups, err := ListBackups(dst, Options{})
+	assert.Nil(err)
+	assert.Equal([]Backup{
+		{Path: dst + "~"},
+		{Path: dst + ".~1~", Number: 1},
+		{Path: dst + ".~3~", Number: 3},
+		{Path: dst + ".~20200101T000000Z~", Time: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)},
+	}, backups)
+
+	backups, err = ListBackups(tmpFile(), Options{})
+	assert.Nil(err)
+	assert.Empty(backups)
+}
+
+func TestRestoreBackup(t *testing.T) {
+	assert := assert.New(t)
+	tests := []struct {
+		name             string
+		opts             Options
+		expectCurrentBkp bool
+	}{
+		{"restore", Options{}, false},
+		{"backup_current_before_restore", Options{Backup: "numbered"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src, dst := tmpFile(), tmpFile()
+			assert.Nil(ioutil.WriteFile(dst, []byte("v1"), 0655))
+			assert.Nil(ioutil.WriteFile(src, []byte("v2"), 0655))
+			assert.Nil(Copy(src, dst, Options{Backup: "numbered"}))
+
+			backups, err := ListBackups(dst, Options{})
+			assert.Nil(err)
+			if !assert.Len(backups, 1) {
+				return
+			}
+			assert.Nil(RestoreBackup(dst, backups[0], tt.opts))
+
+			b, err := ioutil.ReadFile(dst)
+			assert.Nil(err)
+			assert.Equal([]byte("v1"), b)
+
+			b, err = ioutil.ReadFile(dst + ".~2~")
+			if tt.expectCurrentBkp {
+				assert.Nil(err)
+				assert.Equal([]byte("v2"), b)
+			} else {
+				assert.True(os.IsNotExist(err))
+			}
+		})
+	}
+}
+
+func TestRestoreMissingBackup(t *testing.T) {
+	assert := assert.New(t)
+	dst := tmpFile()
+	err := RestoreBackup(dst, Backup{Path: dst + ".~9~", Number: 9}, Options{})
+	assert.Equal(ErrFileNotExist, errors.Cause(err))
+}
+
+func TestAtomicBackupIsTransactional(t *testing.T) {
+	assert := assert.New(t)
+	tests := []struct {
+		name        string
+		backup      string
+		existingBkp bool
+		renameFails bool
+	}{
+		{"simple", "simple", false, false},
+		{"numbered", "numbered", false, false},
+		{"replaces_existing_simple_backup", "simple", true, false},
+		{"rollback_new_backup", "numbered", false, true},
+		{"rollback_restores_replaced_backup", "simple", true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src, dst := tmpFile(), tmpFile()
+			assert.Nil(ioutil.WriteFile(src, []byte("new"), 0655))
+			assert.Nil(ioutil.WriteFile(dst, []byte("old"), 0655))
+			bkp := dst + "~"
+			if tt.backup == "numbered" {
+				bkp = dst + ".~1~"
+			}
+			if tt.existingBkp {
+				assert.Nil(ioutil.WriteFile(bkp, []byte("older"), 0655))
+			}
+			if tt.renameFails {
+				rename = func(string, string) error { return fmt.Errorf("simulated rename failure") }
+				defer func() { rename = os.Rename }()
+			}
+
+			err := Copy(src, dst, Options{Atomic: true, Backup: tt.backup})
+
+			b, readErr := ioutil.ReadFile(dst)
+			assert.Nil(readErr)
+			bkpContent, bkpErr := ioutil.ReadFile(bkp)
+			if tt.renameFails {
+				assert.Equal(ErrCannotRenameTempFile, errors.Cause(err))
+				assert.Equal([]byte("old"), b)
+				if tt.existingBkp {
+					assert.Equal([]byte("older"), bkpContent)
+				} else {
+					assert.True(os.IsNotExist(bkpErr), "backup should be rolled back")
+				}
+			} else {
+				assert.Nil(err)
+				assert.Equal([]byte("new"), b)
+				assert.Equal([]byte("old"), bkpContent)
+			}
+
+			// no temporary files should be left behind
+			m, _ := filepath.Glob(dst + "*.tmp-*")
+			assert.Empty(m)
+		})
+	}
+}
+
+func TestAtomicTreeCopy(t *testing.T) {
+	assert := assert.New(t)
+	tests := []struct {
+		name      string
+		dstExists bool
+		failAfter int
+	}{
+		{name: "new_dst"},
+		{name: "existing_dst_is_merged", dstExists: true},
+		{name: "failure_leaves_dst_untouched", dstExists: true, failAfter: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src, dst := tmpDirPath(), tmpDirPathUnused()
+			assert.Nil(os.MkdirAll(filepath.Join(src, "sub"), 0777))
+			assert.Nil(ioutil.WriteFile(filepath.Join(src, "a.txt"), []byte("new a"), 0655))
+			assert.Nil(ioutil.WriteFile(filepath.Join(src, "sub", "b.txt"), []byte("new b"), 0655))
+			if tt.dstExists {
+				assert.Nil(os.MkdirAll(filepath.Join(dst, "sub"), 0777))
+				assert.Nil(ioutil.WriteFile(filepath.Join(dst, "a.txt"), []byte("old a"), 0655))
+				assert.Nil(ioutil.WriteFile(filepath.Join(dst, "sub", "b.txt"), []byte("old b"), 0655))
+				assert.Nil(ioutil.WriteFile(filepath.Join(dst, "keep.txt"), []byte("keep"), 0655))
+			}
+			if tt.failAfter > 0 {
+				calls := 0
+				rename = func(oldpath, newpath string) error {
+					if calls++; calls > tt.failAfter {
+						return fmt.Errorf("simulated rename failure")
+					}
+					return os.Rename(oldpath, newpath)
+				}
+				defer func() { rename = os.Rename }()
+			}
+
+			err := Copy(src, dst, Options{Recursive: true, AtomicTree: true})
+
+			expected := map[string]string{"a.txt": "new a", "sub/b.txt": "new b"}
+			if tt.dstExists {
+				expected["keep.txt"] = "keep"
+			}
+			if tt.failAfter > 0 {
+				assert.NotNil(err)
+				expected = map[string]string{"a.txt": "old a", "sub/b.txt": "old b", "keep.txt": "keep"}
+			} else {
+				assert.Nil(err)
+			}
+			for name, content := range expected {
+				b, err := ioutil.ReadFile(filepath.Join(dst, filepath.FromSlash(name)))
+				assert.Nil(err)
+				assert.Equal([]byte(content), b, name)
+			}
+
+			// the staging dir must always be cleaned up
+			entries, err := ioutil.ReadDir(filepath.Dir(dst))
+			assert.Nil(err)
+			assert.Len(entries, 1)
+		})
+	}
+}
+
+func TestRenameAsideSwapsDirs(t *testing.T) {
+	assert := assert.New(t)
+	stage, dst := tmpDirPath(), tmpDirPath()
+	assert.Nil(ioutil.WriteFile(filepath.Join(stage, "new.txt"), []byte("new"), 0655))
+	assert.Nil(ioutil.WriteFile(filepath.Join(dst, "old.txt"), []byte("old"), 0655))
+
+	assert.Nil(renameAside(stage, dst))
+	_, err := os.Stat(filepath.Join(dst, "new.txt"))
+	assert.Nil(err)
+	_, err = os.Stat(filepath.Join(stage, "old.txt"))
+	assert.Nil(err)
+}
+
+func TestRenameAsideKeepsErrorChain(t *testing.T) {
+	assert := assert.New(t)
+	stage, dst := tmpDirPath(), tmpDirPath()
+	calls := 0
+	rename = func(oldpath, newpath string) error {
+		calls++
+		if calls == 1 {
+			return os.Rename(oldpath, newpath)
+		}
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: os.ErrPermission}
+	}
+	defer func() { rename = os.Rename }()
+
+	err := renameAside(stage, dst)
+	var linkErr *os.LinkError
+	assert.True(stderrors.As(err, &linkErr))
+	assert.True(stderrors.Is(err, os.ErrPermission))
+	assert.Contains(err.Error(), "cannot restore")
+}
+
+func TestJournalRollback(t *testing.T) {
+	assert := assert.New(t)
+	tests := []struct {
+		name string
+		opts Options
+	}{
+		{"recursive", Options{Recursive: true}},
+		{"recursive_atomic", Options{Recursive: true, Atomic: true}},
+		{"recursive_with_backups", Options{Recursive: true, Backup: "numbered"}},
+		{"atomic_with_backups", Options{Recursive: true, Atomic: true, Backup: "simple"}},
+		{"atomic_tree", Options{Recursive: true, AtomicTree: true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src, dst := tmpDirPath(), tmpDirPathUnused()
+			assert.Nil(os.MkdirAll(filepath.Join(src, "sub", "new"), 0777))
+			assert.Nil(ioutil.WriteFile(filepath.Join(src, "a.txt"), []byte("new a"), 0655))
+			assert.Nil(ioutil.WriteFile(filepath.Join(src, "sub", "new", "b.txt"), []byte("new b"), 0655))
+			assert.Nil(os.MkdirAll(filepath.Join(dst, "sub"), 0777))
+			assert.Nil(ioutil.WriteFile(filepath.Join(dst, "a.txt"), []byte("old a"), 0655))
+			assert.Nil(ioutil.WriteFile(filepath.Join(dst, "sub", "keep.txt"), []byte("keep"), 0655))
+			before := snapshot(dst)
+
+			journal := NewJournal()
+			tt.opts.Journal = journal
+			assert.Nil(Copy(src, dst, tt.opts))
+			assert.NotEqual(before, snapshot(dst))
+
+			assert.Nil(journal.Rollback())
+			assert.Equal(before, snapshot(dst))
+
+			// nothing should be left behind next to dst either
+			entries, err := ioutil.ReadDir(filepath.Dir(dst))
+			assert.Nil(err)
+			assert.Len(entries, 1)
+		})
+	}
+}
+
+func TestJournalCommitRemovesSavedContent(t *testing.T) {
+	assert := assert.New(t)
+	src, dst := tmpDirPath(), tmpDirPath()
+	assert.Nil(ioutil.WriteFile(filepath.Join(src, "a.txt"), []byte("new"), 0655))
+	assert.Nil(ioutil.WriteFile(filepath.Join(dst, "a.txt"), []byte("old"), 0655))
+
+	journal := NewJournal()
+	assert.Nil(Copy(src, dst, Options{Recursive: true, Journal: journal}))
+	assert.Len(snapshot(dst), 3, "saved content should be kept until commit")
+
+	assert.Nil(journal.Commit())
+	assert.Equal(map[string]string{"./": "", "a.txt": "new"}, snapshot(dst))
+
+	// once committed there is nothing left to roll back
+	assert.Nil(journal.Rollback())
+	assert.Equal(map[string]string{"./": "", "a.txt": "new"}, snapshot(dst))
+}
+
+func TestJournalRollbackReportsMissingSavedContent(t *testing.T) {
+	assert := assert.New(t)
+	src, dst := tmpDirPath(), tmpDirPath()
+	assert.Nil(ioutil.WriteFile(filepath.Join(src, "a.txt"), []byte("new"), 0655))
+	assert.Nil(ioutil.WriteFile(filepath.Join(dst, "a.txt"), []byte("old"), 0655))
+
+	journal := NewJournal()
+	assert.Nil(Copy(src, dst, Options{Recursive: true, Journal: journal}))
+	for name := range snapshot(dst) {
+		if strings.Contains(name, ".tmp-") {
+			assert.Nil(os.Remove(filepath.Join(dst, name)))
+		}
+	}
+	err := journal.Rollback()
+	assert.True(os.IsNotExist(err), "rollback should fail, got %v", err)
+}
+
+func TestJournalRollbackThroughSymlink(t *testing.T) {
+	assert := assert.New(t)
+	src, dir := tmpFile(), tmpDirPath()
+	assert.Nil(ioutil.WriteFile(src, []byte("new"), 0644))
+	target := filepath.Join(tmpDirPath(), "target.txt")
+	assert.Nil(ioutil.WriteFile(target, []byte("old"), 0644))
+	dst := filepath.Join(dir, "link.txt")
+	assert.Nil(os.Symlink(target, dst))
+
+	journal := NewJournal()
+	assert.Nil(Copy(src, dst, Options{Journal: journal}))
+	b, err := ioutil.ReadFile(target)
+	assert.Nil(err)
+	assert.Equal("new", string(b), "the copy should write through the link")
+
+	assert.Nil(journal.Rollback())
+	b, err = ioutil.ReadFile(target)
+	assert.Nil(err)
+	assert.Equal("old", string(b))
+	info, err := os.Lstat(dst)
+	assert.Nil(err)
+	assert.True(info.Mode()&os.ModeSymlink != 0, "dst should still be a symbolic link")
+}
+
+func TestJournalRollbackDownload(t *testing.T) {
+	assert := assert.New(t)
+	for _, atomic := range []bool{false, true} {
+		dir := tmpDirPath()
+		dst := filepath.Join(dir, "sub", "f")
+		assert.Nil(os.Mkdir(filepath.Join(dir, "sub"), 0777))
+		assert.Nil(ioutil.WriteFile(dst, []byte("old"), 0644))
+		before := snapshot(dir)
+
+		journal := NewJournal()
+		opts := Options{Atomic: atomic, Journal: journal, ObjectStores: map[string]ObjectStore{"bucket": oneObjectStore{key: "f", content: "new"}}}
+		assert.Nil(Copy("s3://bucket/f", dst, opts))
+		assert.Nil(Copy("s3://bucket/f", filepath.Join(dir, "new", "f"), Options{MkdirAll: true, Journal: journal, ObjectStores: opts.ObjectStores}))
+		b, err := ioutil.ReadFile(dst)
+		assert.Nil(err)
+		assert.Equal("new", string(b))
+
+		assert.Nil(journal.Rollback())
+		assert.Equal(before, snapshot(dir), "atomic %v", atomic)
+	}
+}
+
+func TestJournalRollbackAcrossCopyMany(t *testing.T) {
+	assert := assert.New(t)
+	dst := tmpDirPath()
+	assert.Nil(ioutil.WriteFile(filepath.Join(dst, "exists.txt"), []byte("old"), 0655))
+	before := snapshot(dst)
+
+	src1 := filepath.Join(tmpDirPath(), "exists.txt")
+	assert.Nil(ioutil.WriteFile(src1, []byte("new"), 0655))
+	src2 := tmpFile()
+	missing := tmpFilePathUnused()
+
+	journal := NewJournal()
+	err := CopyMany([]string{src1, src2, missing}, dst, Options{Journal: journal})
+	assert.Equal(ErrFileNotExist, errors.Cause(err))
+
+	assert.Nil(journal.Rollback())
+	assert.Equal(before, snapshot(dst))
+}
+
+func TestDurableCopySurvivesCrash(t *testing.T) {
+	assert := assert.New(t)
+	tests := []struct {
+		name       string
+		dst        string
+		dstExists  bool
+		srcIsDir   bool
+		opts       Options
+		expectLost bool
+	}{
+		{name: "new_file", dst: "dst.txt", opts: Options{Durable: true}},
+		{name: "new_file_without_durable_is_lost", dst: "dst.txt", expectLost: true},
+		{name: "overwrite_with_backup", dst: "dst.txt", dstExists: true, opts: Options{Durable: true, Backup: "numbered"}},
+		{name: "atomic_overwrite_with_backup", dst: "dst.txt", dstExists: true, opts: Options{Durable: true, Atomic: true, Backup: "simple"}},
+		{name: "atomic_overwrite_without_durable_is_lost", dst: "dst.txt", dstExists: true, opts: Options{Atomic: true}, expectLost: true},
+		{name: "backup_dir", dst: "dst.txt", dstExists: true, opts: Options{Durable: true, Backup: "simple", BackupDir: "bkp/deep"}},
+		{name: "mkdir_all", dst: "a/b/c/dst.txt", opts: Options{Durable: true, MkdirAll: true}},
+		{name: "link", dst: "dst.txt", opts: Options{Durable: true, Link: true}},
+		{name: "recursive", dst: "out", srcIsDir: true, opts: Options{Durable: true, Recursive: true}},
+		{name: "atomic_tree", dst: "out", srcIsDir: true, dstExists: true, opts: Options{Durable: true, Recursive: true, AtomicTree: true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := tmpDirPath()
+			src, dst := filepath.Join(root, "src"), filepath.Join(root, filepath.FromSlash(tt.dst))
+			if tt.srcIsDir {
+				assert.Nil(os.MkdirAll(filepath.Join(src, "sub"), 0777))
+				assert.Nil(ioutil.WriteFile(filepath.Join(src, "sub", "a.txt"), []byte("new"), 0655))
+				if tt.dstExists {
+					assert.Nil(os.MkdirAll(filepath.Join(dst, "old"), 0777))
+					assert.Nil(ioutil.WriteFile(filepath.Join(dst, "old", "b.txt"), []byte("old"), 0655))
+				}
+			} else {
+				assert.Nil(ioutil.WriteFile(src, []byte("new"), 0655))
+				if tt.dstExists {
+					assert.Nil(ioutil.WriteFile(dst, []byte("old"), 0655))
+				}
+			}
+			if tt.opts.BackupDir != "" {
+				tt.opts.BackupDir = filepath.Join(root, filepath.FromSlash(tt.opts.BackupDir))
+			}
+
+			fs := newCrashFS(root)
+			defer fs.install()()
+			tt.opts.InfoLogFunc, tt.opts.DebugLogFunc = infoLogger, debugLogger
+			assert.Nil(Copy(src, dst, tt.opts))
+
+			lost := fs.lost(root)
+			if tt.expectLost {
+				assert.NotEmpty(lost)
+			} else {
+				assert.Empty(lost)
+			}
+		})
+	}
+}
+
+func TestDurableSyncFailure(t *testing.T) {
+	assert := assert.New(t)
+	root := tmpDirPath()
+	src, dst := filepath.Join(root, "src.txt"), filepath.Join(root, "a", "dst.txt")
+	assert.Nil(ioutil.WriteFile(src, []byte("new"), 0655))
+
+	fs := newCrashFS(root)
+	fs.failSync = dst
+	defer fs.install()()
+	err := Copy(src, dst, Options{Durable: true, MkdirAll: true})
+	assert.Equal(ErrCannotSyncDir, errors.Cause(err))
+}
+
+func TestOneFileSystemSkipsMountPoints(t *testing.T) {
+	assert := assert.New(t)
+	deviceOf = func(info os.FileInfo) (uint64, bool) {
+		if info.Name() == "mnt" {
+			return 2, true
+		}
+		return 1, true
+	}
+	defer func() { deviceOf = fileDevice }()
+
+	tests := []struct {
+		name        string
+		oneFS       bool
+		expectMount bool
+	}{
+		{name: "crosses_mount_points_by_default", expectMount: true},
+		{name: "one_file_system", oneFS: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src, dst := tmpDirPath(), tmpDirPathUnused()
+			assert.Nil(os.MkdirAll(filepath.Join(src, "mnt"), 0777))
+			assert.Nil(os.MkdirAll(filepath.Join(src, "sub"), 0777))
+			assert.Nil(ioutil.WriteFile(filepath.Join(src, "mnt", "a.txt"), []byte("a"), 0644))
+			assert.Nil(ioutil.WriteFile(filepath.Join(src, "sub", "b.txt"), []byte("b"), 0644))
+
+			var logged []string
+			err := Copy(src, dst, Options{
+				Recursive:     true,
+				OneFileSystem: tt.oneFS,
+				InfoLogFunc:   func(msg string) { logged = append(logged, msg) },
+			})
+			assert.Nil(err)
+
+			expected := map[string]string{"./": "", "sub/": "", "sub/b.txt": "b"}
+			if tt.expectMount {
+				expected["mnt/"], expected["mnt/a.txt"] = "", "a"
+			}
+			assert.Equal(expected, snapshot(dst))
+			assert.Equal(!tt.expectMount, strings.Contains(strings.Join(logged, "\n"), "skipping mount point, it is on a different file system src="+filepath.Join(src, "mnt")))
+		})
+	}
+}
+
+// recordingLogger is a Logger which keeps every message with its fields.
+type recordingLogger struct {
+	entries []logEntry
+}
+
+type logEntry struct {
+	level, msg string
+	fields     map[string]interface{}
+}
+
+func (r *recordingLogger) record(level, msg string, keyvals []interface{}) {
+	fields := map[string]interface{}{}
+	for i := 0; i+1 < len(keyvals); i += 2 {
+		fields[keyvals[i].(string)] = keyvals[i+1]
+	}
+	r.entries = append(r.entries, logEntry{level: level, msg: msg, fields: fields})
+}
+
+func (r *recordingLogger) Debug(msg string, keyvals ...interface{}) { r.record("debug", msg, keyvals) }
+func (r *recordingLogger) Info(msg string, keyvals ...interface{})  { r.record("info", msg, keyvals) }
+
+func TestLoggerReceivesStructuredFields(t *testing.T) {
+	assert := assert.New(t)
+	src, dst := tmpFile(), tmpFilePathUnused()
+	assert.Nil(ioutil.WriteFile(src, []byte("foo"), 0644))
+
+	logger := &recordingLogger{}
+	// the log funcs are ignored when a Logger is given
+	called := false
+	assert.Nil(Copy(src, dst, Options{Logger: logger, InfoLogFunc: func(string) { called = true }}))
+	assert.False(called)
+
+	var copied *logEntry
+	for i, e := range logger.entries {
+		if e.msg == "copied file" {
+			copied = &logger.entries[i]
+		}
+	}
+	if assert.NotNil(copied) {
+		assert.Equal("info", copied.level)
+		assert.Equal(src, copied.fields["src"])
+		assert.Equal(dst, copied.fields["dst"])
+		assert.Equal(int64(3), copied.fields["bytes"])
+		assert.IsType(time.Duration(0), copied.fields["elapsed"])
+	}
+}
+
+func TestLogFuncsFormatFields(t *testing.T) {
+	assert := assert.New(t)
+	assert.Equal("copied file src=/a bytes=3", formatLog("copied file", []interface{}{"src", "/a", "bytes", 3}))
+	assert.Equal(`msg err="no such file"`, formatLog("msg", []interface{}{"err", errors.New("no such file")}))
+	assert.Equal("msg odd=MISSING", formatLog("msg", []interface{}{"odd"}))
+
+	src, dst := tmpFile(), tmpFilePathUnused()
+	var logged []string
+	assert.Nil(Copy(src, dst, Options{InfoLogFunc: func(msg string) { logged = append(logged, msg) }}))
+	assert.True(strings.HasPrefix(logged[len(logged)-1], "copied file src="+src+" dst="+dst+" bytes=0 elapsed="))
+}
+
+func TestZerologLogger(t *testing.T) {
+	assert := assert.New(t)
+	var buf bytes.Buffer
+	logger := NewZerologLogger(zerolog.New(&buf))
+	logger.Info("copied file", "src", "/a", "bytes", int64(3), "elapsed", time.Second, "err", errors.New("boom"))
+
+	var event map[string]interface{}
+	assert.Nil(json.Unmarshal(buf.Bytes(), &event))
+	assert.Equal("info", event["level"])
+	assert.Equal("copied file", event["message"])
+	assert.Equal("/a", event["src"])
+	assert.Equal(float64(3), event["bytes"])
+	assert.Equal("boom", event["err"])
+	assert.Contains(event, "elapsed")
+}
+
+// hookRecorder returns Hooks which append each call to events.
+func hookRecorder(events *[]string) Hooks {
+	return Hooks{
+		BeforeCopy: func(src, dst string) error {
+			*events = append(*events, "before copy "+src+" "+dst)
+			return nil
+		},
+		AfterCopy: func(src, dst string, bytes int64) {
+			*events = append(*events, fmt.Sprintf("after copy %s %s %d", src, dst, bytes))
+		},
+		OnMkdir:  func(dir string) { *events = append(*events, "mkdir "+dir) },
+		OnBackup: func(file, backup string) { *events = append(*events, "backup "+file+" "+backup) },
+		OnLink:   func(src, dst string) { *events = append(*events, "link "+src+" "+dst) },
+		OnSymlink: func(src, dst, target string) {
+			*events = append(*events, "symlink "+src+" "+dst+" "+target)
+		},
+		OnSpecial: func(src, dst string) { *events = append(*events, "special "+src+" "+dst) },
+		OnDelete:  func(dst string) { *events = append(*events, "delete "+dst) },
+		OnSkip:    func(src, dst, reason string) { *events = append(*events, "skip "+src+" "+dst+" "+reason) },
+		OnChmod:   func(dst string, mode os.FileMode) { *events = append(*events, fmt.Sprintf("chmod %s %s", dst, mode)) },
+	}
+}
+
+func TestHooksReportChanges(t *testing.T) {
+	assert := assert.New(t)
+	tests := []struct {
+		name     string
+		dstExist bool
+		opts     Options
+		expected func(src, dst string) []string
+	}{
+		{
+			name: "copy_with_mkdir",
+			opts: Options{MkdirAll: true},
+			expected: func(src, dst string) []string {
+				return []string{
+					"before copy " + src + " " + dst,
+					"mkdir " + filepath.Dir(dst),
+					"chmod " + dst + " -rw-r-----",
+					"after copy " + src + " " + dst + " 3",
+				}
+			},
+		},
+		{
+			name:     "backup",
+			dstExist: true,
+			opts:     Options{Backup: "simple"},
+			expected: func(src, dst string) []string {
+				return []string{
+					"before copy " + src + " " + dst,
+					"backup " + dst + " " + dst + "~",
+					"after copy " + src + " " + dst + " 3",
+				}
+			},
+		},
+		{
+			name:     "atomic_backup",
+			dstExist: true,
+			opts:     Options{Backup: "simple", Atomic: true},
+			expected: func(src, dst string) []string {
+				return []string{
+					"before copy " + src + " " + dst,
+					"chmod " + dst + " -rw-r-----",
+					"backup " + dst + " " + dst + "~",
+					"after copy " + src + " " + dst + " 3",
+				}
+			},
+		},
+		{
+			name:     "no_clobber",
+			dstExist: true,
+			opts:     Options{NoClobber: true},
+			expected: func(src, dst string) []string {
+				return []string{"skip " + src + " " + dst + " no clobber"}
+			},
+		},
+		{
+			name: "link",
+			opts: Options{Link: true},
+			expected: func(src, dst string) []string {
+				return []string{"before copy " + src + " " + dst, "link " + src + " " + dst}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src := tmpFile()
+			assert.Nil(ioutil.WriteFile(src, []byte("new"), 0640))
+			assert.Nil(os.Chmod(src, 0640))
+			dst := filepath.Join(tmpDirPathUnused(), "dst.txt")
+			if !tt.opts.MkdirAll {
+				assert.Nil(os.MkdirAll(filepath.Dir(dst), 0777))
+			}
+			if tt.dstExist {
+				assert.Nil(ioutil.WriteFile(dst, []byte("old"), 0640))
+				assert.Nil(os.Chmod(dst, 0640))
+			}
+
+			var events []string
+			tt.opts.Hooks = hookRecorder(&events)
+			assert.Nil(Copy(src, dst, tt.opts))
+			assert.Equal(tt.expected(src, dst), events)
+		})
+	}
+}
+
+func TestHooksReportSkippedEntries(t *testing.T) {
+	assert := assert.New(t)
+	deviceOf = func(info os.FileInfo) (uint64, bool) {
+		if info.Name() == "mnt" {
+			return 2, true
+		}
+		return 1, true
+	}
+	defer func() { deviceOf = fileDevice }()
+
+	src, dst := tmpDirPath(), tmpDirPathUnused()
+	assert.Nil(os.MkdirAll(filepath.Join(src, "mnt"), 0777))
+
+	var events []string
+	assert.Nil(Copy(src, dst, Options{Recursive: true, MkdirAll: true, OneFileSystem: true, Hooks: hookRecorder(&events)}))
+	assert.Equal([]string{
+		"mkdir " + dst,
+		"skip " + filepath.Join(src, "mnt") + " " + filepath.Join(dst, "mnt") + " mount point",
+	}, events)
+}
+
+func TestBeforeCopyVeto(t *testing.T) {
+	assert := assert.New(t)
+	src, dst := tmpDirPath(), tmpDirPathUnused()
+	assert.Nil(ioutil.WriteFile(filepath.Join(src, "a.txt"), []byte("a"), 0644))
+	assert.Nil(ioutil.WriteFile(filepath.Join(src, "secret.txt"), []byte("s"), 0644))
+
+	errVeto := errors.New("vetoed")
+	err := Copy(src, dst, Options{
+		Recursive: true,
+		MkdirAll:  true,
+		Hooks: Hooks{BeforeCopy: func(src, dst string) error {
+			if filepath.Base(src) == "secret.txt" {
+				return errVeto
+			}
+			return nil
+		}},
+	})
+	assert.Equal(errVeto, err)
+	assert.Equal(map[string]string{"./": "", "a.txt": "a"}, snapshot(dst))
+}
+
+func TestHooksForDownloadsAndSyncDeletes(t *testing.T) {
+	assert := assert.New(t)
+	dir := tmpDirPath()
+	dst := filepath.Join(dir, "f")
+	stores := map[string]ObjectStore{"bucket": oneObjectStore{key: "p/f", content: "new"}}
+
+	var events []string
+	assert.Nil(Copy("s3://bucket/p/f", dst, Options{ObjectStores: stores, Hooks: hookRecorder(&events)}))
+	assert.Equal([]string{
+		"before copy s3://bucket/p/f " + dst,
+		"chmod " + dst + " -rw-r--r--",
+		"after copy s3://bucket/p/f " + dst + " 3",
+	}, events)
+
+	errVeto := errors.New("vetoed")
+	vetoed := filepath.Join(dir, "vetoed")
+	err := Copy("s3://bucket/p/f", vetoed, Options{ObjectStores: stores, Hooks: Hooks{BeforeCopy: func(src, dst string) error {
+		return errVeto
+	}}})
+	assert.Equal(errVeto, err)
+	_, err = os.Lstat(vetoed)
+	assert.True(os.IsNotExist(err))
+
+	src := tmpDirPath()
+	events = nil
+	_, err = Sync(src, dir, SyncOptions{Delete: true, Options: Options{Hooks: hookRecorder(&events)}})
+	assert.Nil(err)
+	assert.Equal([]string{"delete " + dst}, events)
+}
+
+func TestOnConflict(t *testing.T) {
+	assert := assert.New(t)
+	errAsk := errors.New("cannot ask")
+	tests := []struct {
+		name        string
+		decision    Decision
+		decideErr   error
+		noClobber   bool
+		expectErr   error
+		expected    map[string]string
+		expectAsked bool
+	}{
+		{name: "overwrite", decision: Overwrite, expectAsked: true, expected: map[string]string{"./": "", "dst.txt": "new"}},
+		{name: "skip", decision: Skip, expectAsked: true, expected: map[string]string{"./": "", "dst.txt": "old"}},
+		{name: "rename_new", decision: RenameNew, expectAsked: true, expected: map[string]string{"./": "", "dst.txt": "old", "dst-1.txt": "new"}},
+		{name: "backup_then_overwrite", decision: BackupThenOverwrite, expectAsked: true, expected: map[string]string{"./": "", "dst.txt": "new", "dst.txt~": "old"}},
+		{name: "abort", decision: Abort, expectAsked: true, expectErr: ErrConflictAborted, expected: map[string]string{"./": "", "dst.txt": "old"}},
+		{name: "unknown_decision", decision: Decision(42), expectAsked: true, expectErr: ErrConflictAborted, expected: map[string]string{"./": "", "dst.txt": "old"}},
+		{name: "callback_error", decideErr: errAsk, expectAsked: true, expectErr: errAsk, expected: map[string]string{"./": "", "dst.txt": "old"}},
+		{name: "no_clobber_takes_precedence", decision: Overwrite, noClobber: true, expected: map[string]string{"./": "", "dst.txt": "old"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src := tmpFile()
+			assert.Nil(ioutil.WriteFile(src, []byte("new"), 0644))
+			dir := tmpDirPath()
+			dst := filepath.Join(dir, "dst.txt")
+			assert.Nil(ioutil.WriteFile(dst, []byte("old"), 0644))
+
+			var asked bool
+			err := Copy(src, dst, Options{
+				NoClobber: tt.noClobber,
+				OnConflict: func(srcInfo, dstInfo os.FileInfo) (Decision, error) {
+					asked = true
+					assert.Equal(filepath.Base(src), srcInfo.Name())
+					assert.Equal("dst.txt", dstInfo.Name())
+					return tt.decision, tt.decideErr
+				},
+			})
+			assert.Equal(tt.expectErr, errors.Cause(err))
+			assert.Equal(tt.expectAsked, asked)
+			assert.Equal(tt.expected, snapshot(dir))
+		})
+	}
+}
+
+func TestOnConflictNotAskedForNewDst(t *testing.T) {
+	assert := assert.New(t)
+	src, dst := tmpFile(), tmpFilePathUnused()
+	err := Copy(src, dst, Options{
+		OnConflict: func(src, dst os.FileInfo) (Decision, error) {
+			return Abort, nil
+		},
+	})
+	assert.Nil(err)
+	assert.FileExists(dst)
+}
+
+func TestOnConflictNotAskedForBackup(t *testing.T) {
+	assert := assert.New(t)
+	src, dst := tmpFile(), tmpFile()
+	assert.Nil(ioutil.WriteFile(src, []byte("new"), 0644))
+	assert.Nil(ioutil.WriteFile(dst, []byte("old"), 0644))
+	assert.Nil(ioutil.WriteFile(dst+"~", []byte("older"), 0644))
+
+	var asked []string
+	err := Copy(src, dst, Options{
+		Backup: "simple",
+		OnConflict: func(src, dst os.FileInfo) (Decision, error) {
+			asked = append(asked, dst.Name())
+			if strings.HasSuffix(dst.Name(), "~") {
+				return Skip, nil
+			}
+			return Overwrite, nil
+		},
+	})
+	assert.Nil(err)
+	assert.Equal([]string{filepath.Base(dst)}, asked)
+	b, err := ioutil.ReadFile(dst + "~")
+	assert.Nil(err)
+	assert.Equal("old", string(b))
+}
+
+func TestCopyWithResult(t *testing.T) {
+	assert := assert.New(t)
+	tests := []struct {
+		name       string
+		atomicTree bool
+	}{
+		{name: "recursive"},
+		{name: "atomic_tree", atomicTree: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src, dst := tmpDirPath(), tmpDirPath()
+			assert.Nil(os.MkdirAll(filepath.Join(src, "sub"), 0777))
+			assert.Nil(ioutil.WriteFile(filepath.Join(src, "a.txt"), []byte("aaa"), 0644))
+			assert.Nil(ioutil.WriteFile(filepath.Join(src, "sub", "b.txt"), []byte("bb"), 0644))
+			assert.Nil(ioutil.WriteFile(filepath.Join(src, "kept.txt"), []byte("new"), 0644))
+			assert.Nil(ioutil.WriteFile(filepath.Join(dst, "kept.txt"), []byte("old"), 0644))
+
+			var afterCopy int
+			result, err := CopyWithResult(src, dst, Options{
+				Recursive:   true,
+				AtomicTree:  tt.atomicTree,
+				NoClobber:   true,
+				RecordFiles: true,
+				Hooks:       Hooks{AfterCopy: func(src, dst string, bytes int64) { afterCopy++ }},
+			})
+			assert.Nil(err)
+			assert.Equal(2, afterCopy, "hooks given in Options are still called")
+			assert.Equal(2, result.Copied)
+			assert.Equal(1, result.Skipped)
+			assert.Equal(1, result.DirsCreated)
+			assert.Equal(int64(5), result.Bytes)
+			assert.True(result.Elapsed > 0)
+			assert.Equal([]FileRecord{
+				{Op: "copy", Src: filepath.Join(src, "a.txt"), Dst: filepath.Join(dst, "a.txt"), Bytes: 3},
+				{Op: "skip", Src: filepath.Join(src, "kept.txt"), Dst: filepath.Join(dst, "kept.txt"), Reason: "no clobber"},
+				{Op: "copy", Src: filepath.Join(src, "sub", "b.txt"), Dst: filepath.Join(dst, "sub", "b.txt"), Bytes: 2},
+			}, result.Files)
+		})
+	}
+}
+
+func TestCopyWithResultBackupsAndLinks(t *testing.T) {
+	assert := assert.New(t)
+	src, dst := tmpFile(), tmpFile()
+
+	result, err := CopyWithResult(src, dst, Options{Backup: "numbered"})
+	assert.Nil(err)
+	assert.Equal([]string{dst + ".~1~"}, result.Backups)
+	assert.Nil(result.Files, "records are only kept with RecordFiles")
+
+	linked := tmpFilePathUnused()
+	result, err = CopyWithResult(src, linked, Options{Link: true})
+	assert.Nil(err)
+	assert.Equal(1, result.Linked)
+	assert.Equal(0, result.Copied)
+}
+
+func TestErrorsMatchKindAndOSError(t *testing.T) {
+	assert := assert.New(t)
+	tests := []struct {
+		name     string
+		setup    func() (src, dst string)
+		nonRoot  bool
+		op       string
+		kind     error
+		osErr    error
+		expected func(src, dst string) string
+	}{
+		{
+			name: "missing_dst_dir",
+			setup: func() (string, string) {
+				return tmpFile(), filepath.Join(tmpDirPathUnused(), "dst.txt")
+			},
+			op:    "open",
+			kind:  ErrCannotOpenOrCreateDstFile,
+			osErr: os.ErrNotExist,
+			expected: func(src, dst string) string {
+				return "open " + filepath.Dir(dst) + ": destination file cannot be created: no such file or directory"
+			},
+		},
+		{
+			name: "unreadable_src",
+			setup: func() (string, string) {
+				src := tmpFile()
+				assert.Nil(os.Chmod(src, 0))
+				return src, tmpFilePathUnused()
+			},
+			nonRoot: true,
+			op:      "open",
+			kind:    ErrCannotOpenSrc,
+			osErr:   os.ErrPermission,
+			expected: func(src, dst string) string {
+				return "open " + src + ": source file cannot be opened: permission denied"
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.nonRoot && (runtime.GOOS == "windows" || os.Geteuid() == 0) {
+				t.Skip("permissions are not enforced")
+			}
+			src, dst := tt.setup()
+			err := Copy(src, dst, Options{})
+
+			var flopErr *Error
+			assert.True(stderrors.As(err, &flopErr))
+			assert.Equal(tt.op, flopErr.Op)
+			assert.True(stderrors.Is(err, tt.kind))
+			assert.True(stderrors.Is(err, tt.osErr))
+			assert.False(stderrors.Is(err, ErrCannotStatFile))
+			assert.Equal(tt.kind, errors.Cause(err))
+			assert.Equal(tt.expected(src, dst), err.Error())
+		})
+	}
+}
+
+func TestLimiterWaits(t *testing.T) {
+	assert := assert.New(t)
+	clock := &fakeClock{}
+	defer clock.install()()
+
+	l := NewLimiter(100)
+	var sleeps []time.Duration
+	for i := 0; i < 4; i++ {
+		before := clock.slept
+		l.wait(50)
+		sleeps = append(sleeps, clock.slept-before)
+	}
+	assert.Equal([]time.Duration{0, 500 * time.Millisecond, 500 * time.Millisecond, 500 * time.Millisecond}, sleeps)
+
+	// time spent idle is not saved up for a burst
+	clock.Sleep(time.Hour)
+	before := clock.slept
+	l.wait(100)
+	l.wait(100)
+	assert.Equal(time.Second, clock.slept-before)
+
+	unlimited := NewLimiter(0)
+	unlimited.wait(100)
+	assert.Equal(before+time.Second, clock.slept)
+}
+
+func TestBytesPerSecondLimitsWholeTree(t *testing.T) {
+	assert := assert.New(t)
+	tests := []struct {
+		name     string
+		opts     Options
+		expected time.Duration
+	}{
+		{name: "unlimited", opts: Options{}},
+		{name: "bytes_per_second", opts: Options{BytesPerSecond: 100}, expected: 2 * time.Second},
+		{name: "atomic", opts: Options{BytesPerSecond: 100, Atomic: true}, expected: 2 * time.Second},
+		{name: "shared_limiter", opts: Options{BytesPerSecond: 1, Limiter: NewLimiter(50)}, expected: 4 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := &fakeClock{}
+			defer clock.install()()
+			src, dst := tmpDirPath(), tmpDirPathUnused()
+			assert.Nil(os.MkdirAll(filepath.Join(src, "sub"), 0777))
+			for _, name := range []string{"a.txt", "b.txt", filepath.Join("sub", "c.txt")} {
+				assert.Nil(ioutil.WriteFile(filepath.Join(src, name), bytes.Repeat([]byte("x"), 100), 0644))
+			}
+
+			tt.opts.Recursive, tt.opts.MkdirAll = true, true
+			assert.Nil(Copy(src, dst, tt.opts))
+			// the first file is copied straight away, the rest wait for the bytes before them
+			assert.Equal(tt.expected, clock.slept)
+			assert.Equal(snapshot(src), snapshot(dst))
+		})
+	}
+}
+
+// writeResumeState saves a resume state for src at offset next to dst, as an interrupted Atomic copy would.
+func writeResumeState(src, dst string, offset int64) error {
+	info, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(resumeState{Src: src, Size: info.Size(), ModTime: info.ModTime(), Offset: offset})
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(filepath.Dir(dst), resumeTempName(dst))
+	return ioutil.WriteFile(resumeStateName(tmp), b, 0600)
+}
+
+func TestResume(t *testing.T) {
+	assert := assert.New(t)
+	tests := []struct {
+		name        string
+		atomic      bool
+		dst         string
+		tmp         string
+		stateOffset int64
+		stateSrc    string
+		expectBytes int64
+		expected    map[string]string
+	}{
+		{
+			name:        "partial_dst",
+			dst:         "hello ",
+			expectBytes: 5,
+			expected:    map[string]string{"./": "", "dst.txt": "hello world"},
+		},
+		{
+			name:        "dst_does_not_match",
+			dst:         "jello ",
+			expectBytes: 11,
+			expected:    map[string]string{"./": "", "dst.txt": "hello world", "dst.txt~": "jello "},
+		},
+		{
+			name:        "dst_longer_than_src",
+			dst:         "hello world!",
+			expectBytes: 11,
+			expected:    map[string]string{"./": "", "dst.txt": "hello world", "dst.txt~": "hello world!"},
+		},
+		{
+			name:        "atomic_saved_tmp",
+			atomic:      true,
+			tmp:         "hello w\x00\x00",
+			stateOffset: 7,
+			expectBytes: 4,
+			expected:    map[string]string{"./": "", "dst.txt": "hello world"},
+		},
+		{
+			name:        "atomic_tmp_does_not_match",
+			atomic:      true,
+			tmp:         "jello w",
+			stateOffset: 7,
+			expectBytes: 11,
+			expected:    map[string]string{"./": "", "dst.txt": "hello world"},
+		},
+		{
+			name:        "atomic_state_for_other_src",
+			atomic:      true,
+			tmp:         "hello w",
+			stateOffset: 7,
+			stateSrc:    "other.txt",
+			expectBytes: 11,
+			expected:    map[string]string{"./": "", "dst.txt": "hello world"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src := tmpFile()
+			assert.Nil(ioutil.WriteFile(src, []byte("hello world"), 0644))
+			dir := tmpDirPath()
+			dst := filepath.Join(dir, "dst.txt")
+			if tt.dst != "" {
+				assert.Nil(ioutil.WriteFile(dst, []byte(tt.dst), 0644))
+			}
+			if tt.tmp != "" {
+				assert.Nil(ioutil.WriteFile(filepath.Join(dir, resumeTempName(dst)), []byte(tt.tmp), 0600))
+				stateSrc := src
+				if tt.stateSrc != "" {
+					stateSrc = filepath.Join(filepath.Dir(src), tt.stateSrc)
+					assert.Nil(ioutil.WriteFile(stateSrc, []byte("other"), 0644))
+				}
+				assert.Nil(writeResumeState(stateSrc, dst, tt.stateOffset))
+			}
+
+			result, err := CopyWithResult(src, dst, Options{Resume: true, Atomic: tt.atomic, Backup: "simple"})
+			assert.Nil(err)
+			assert.Equal(tt.expectBytes, result.Bytes)
+			assert.Equal(tt.expected, snapshot(dir), "the tmp file and its state are removed once renamed")
+		})
+	}
+}
+
+func TestResumeKeepsTmpOnFailure(t *testing.T) {
+	assert := assert.New(t)
+	resumeCheckpoint = 4
+	defer func() { resumeCheckpoint = 16 << 20 }()
+
+	src := tmpFile()
+	assert.Nil(ioutil.WriteFile(src, []byte("hello world"), 0644))
+	dir := tmpDirPath()
+	dst := filepath.Join(dir, "dst.txt")
+	tmp := filepath.Join(dir, resumeTempName(dst))
+
+	rename = func(string, string) error { return errors.New("simulated rename failure") }
+	_, err := CopyWithResult(src, dst, Options{Resume: true, Atomic: true})
+	rename = os.Rename
+	assert.Equal(ErrCannotRenameTempFile, errors.Cause(err))
+	b, err := ioutil.ReadFile(tmp)
+	assert.Nil(err)
+	assert.Equal("hello world", string(b))
+	b, err = ioutil.ReadFile(resumeStateName(tmp))
+	assert.Nil(err)
+	var state resumeState
+	assert.Nil(json.Unmarshal(b, &state))
+	assert.Equal(int64(11), state.Offset)
+
+	result, err := CopyWithResult(src, dst, Options{Resume: true, Atomic: true})
+	assert.Nil(err)
+	assert.Equal(int64(0), result.Bytes)
+	assert.Equal(map[string]string{"./": "", "dst.txt": "hello world"}, snapshot(dir))
+}
+
+// writeTree creates the files in tree under root, keyed like snapshot.  Every file is given the modification
+// time mtime.
+func writeTree(root string, tree map[string]string, mtime time.Time) error {
+	for rel, content := range tree {
+		p := filepath.Join(root, filepath.FromSlash(rel))
+		if strings.HasSuffix(rel, "/") {
+			if err := os.MkdirAll(p, 0755); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(p, []byte(content), 0644); err != nil {
+			return err
+		}
+		if err := os.Chtimes(p, mtime, mtime); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestSync(t *testing.T) {
+	assert := assert.New(t)
+	mtime := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	srcTree := map[string]string{"a.txt": "a", "sub/b.txt": "bb", "empty/": ""}
+	synced := map[string]string{"./": "", "a.txt": "a", "sub/": "", "sub/b.txt": "bb", "empty/": ""}
+	tests := []struct {
+		name      string
+		dstExists bool
+		src       map[string]string
+		dst       map[string]string
+		opts      SyncOptions
+		expectErr error
+		expected  SyncReport
+		expectDst map[string]string
+	}{
+		{
+			name:      "new_tree",
+			expected:  SyncReport{Created: []string{".", "a.txt", "empty", "sub", "sub/b.txt"}},
+			expectDst: synced,
+		},
+		{
+			name:      "unchanged",
+			dst:       srcTree,
+			expectDst: synced,
+		},
+		{
+			name:      "changed_size",
+			src:       map[string]string{"a.txt": "aa"},
+			dst:       srcTree,
+			expected:  SyncReport{Updated: []string{"a.txt"}},
+			expectDst: map[string]string{"./": "", "a.txt": "aa", "sub/": "", "sub/b.txt": "bb", "empty/": ""},
+		},
+		{
+			name:      "changed_mtime",
+			src:       map[string]string{"a.txt": "z"},
+			dst:       srcTree,
+			expected:  SyncReport{Updated: []string{"a.txt"}},
+			expectDst: map[string]string{"./": "", "a.txt": "z", "sub/": "", "sub/b.txt": "bb", "empty/": ""},
+		},
+		{
+			name:      "checksum_ignores_mtime",
+			src:       map[string]string{"a.txt": "a"},
+			dst:       map[string]string{"a.txt": "a", "sub/b.txt": "zz", "empty/": ""},
+			opts:      SyncOptions{Checksum: true},
+			expected:  SyncReport{Updated: []string{"sub/b.txt"}},
+			expectDst: synced,
+		},
+		{
+			name:      "keeps_extra_entries",
+			dst:       map[string]string{"a.txt": "a", "sub/b.txt": "bb", "empty/": "", "old.txt": "old"},
+			expectDst: map[string]string{"./": "", "a.txt": "a", "sub/": "", "sub/b.txt": "bb", "empty/": "", "old.txt": "old"},
+		},
+		{
+			name:      "delete_and_protect",
+			dst:       map[string]string{"a.txt": "a", "sub/b.txt": "bb", "empty/": "", "old.txt": "old", "olddir/x": "x", "sub/keep.log": "log"},
+			opts:      SyncOptions{Delete: true, Protect: []string{"*.log"}},
+			expected:  SyncReport{Deleted: []string{"old.txt", "olddir"}, Protected: []string{"sub/keep.log"}},
+			expectDst: map[string]string{"./": "", "a.txt": "a", "sub/": "", "sub/b.txt": "bb", "empty/": "", "sub/keep.log": "log"},
+		},
+		{
+			name:      "exclude",
+			src:       map[string]string{"x.tmp": "x"},
+			dst:       map[string]string{"a.txt": "a", "sub/b.txt": "bb", "empty/": "", "y.tmp": "y"},
+			opts:      SyncOptions{Delete: true, Exclude: []string{"*.tmp"}},
+			expectDst: map[string]string{"./": "", "a.txt": "a", "sub/": "", "sub/b.txt": "bb", "empty/": "", "y.tmp": "y"},
+		},
+		{
+			name:      "dry_run",
+			src:       map[string]string{"a.txt": "aa", "c.txt": "c"},
+			dst:       map[string]string{"a.txt": "a", "sub/b.txt": "bb", "empty/": "", "old.txt": "old"},
+			opts:      SyncOptions{Delete: true, DryRun: true},
+			expected:  SyncReport{Created: []string{"c.txt"}, Updated: []string{"a.txt"}, Deleted: []string{"old.txt"}},
+			expectDst: map[string]string{"./": "", "a.txt": "a", "sub/": "", "sub/b.txt": "bb", "empty/": "", "old.txt": "old"},
+		},
+		{
+			name:      "dry_run_new_tree",
+			opts:      SyncOptions{Delete: true, DryRun: true},
+			expected:  SyncReport{Created: []string{".", "a.txt", "empty", "sub", "sub/b.txt"}},
+			expectDst: map[string]string{},
+		},
+		{
+			name:      "no_clobber_reports_skipped",
+			src:       map[string]string{"a.txt": "aa", "c.txt": "c"},
+			dst:       srcTree,
+			opts:      SyncOptions{Options: Options{NoClobber: true}},
+			expected:  SyncReport{Created: []string{"c.txt"}, Skipped: []string{"a.txt"}},
+			expectDst: map[string]string{"./": "", "a.txt": "a", "c.txt": "c", "sub/": "", "sub/b.txt": "bb", "empty/": ""},
+		},
+		{
+			name: "on_conflict_skip_reports_skipped",
+			src:  map[string]string{"a.txt": "aa", "c.txt": "c"},
+			dst:  srcTree,
+			opts: SyncOptions{Options: Options{OnConflict: func(src, dst os.FileInfo) (Decision, error) {
+				return Skip, nil
+			}}},
+			expected:  SyncReport{Created: []string{"c.txt"}, Skipped: []string{"a.txt"}},
+			expectDst: map[string]string{"./": "", "a.txt": "a", "c.txt": "c", "sub/": "", "sub/b.txt": "bb", "empty/": ""},
+		},
+		{
+			name:      "dry_run_no_clobber",
+			src:       map[string]string{"a.txt": "aa"},
+			dst:       srcTree,
+			opts:      SyncOptions{Options: Options{NoClobber: true}, DryRun: true},
+			expected:  SyncReport{Skipped: []string{"a.txt"}},
+			expectDst: synced,
+		},
+		{
+			name:      "type_change_needs_delete",
+			dst:       map[string]string{"a.txt/x": "x", "sub/b.txt": "bb", "empty/": ""},
+			expectErr: ErrWritingFileToExistingDir,
+			expectDst: map[string]string{"./": "", "a.txt/": "", "a.txt/x": "x", "sub/": "", "sub/b.txt": "bb", "empty/": ""},
+		},
+		{
+			name:      "type_change_with_delete",
+			dst:       map[string]string{"a.txt/x": "x", "sub/b.txt": "bb", "empty/": ""},
+			opts:      SyncOptions{Delete: true},
+			expected:  SyncReport{Updated: []string{"a.txt"}},
+			expectDst: synced,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src, dst := tmpDirPath(), tmpDirPathUnused()
+			assert.Nil(writeTree(src, srcTree, mtime))
+			assert.Nil(writeTree(src, tt.src, mtime.Add(time.Hour)))
+			if tt.dst != nil {
+				assert.Nil(writeTree(dst, tt.dst, mtime))
+			}
+
+			report, err := Sync(src, dst, tt.opts)
+			assert.Equal(tt.expectErr, errors.Cause(err))
+			assert.Equal(tt.expected, report)
+			assert.Equal(tt.expectDst, snapshot(dst))
+			if err != nil || tt.opts.DryRun {
+				return
+			}
+
+			// a second sync finds nothing to do, but what was kept is still changed
+			report, err = Sync(src, dst, tt.opts)
+			assert.Nil(err)
+			assert.Equal(SyncReport{Protected: report.Protected, Skipped: tt.expected.Skipped}, report)
+		})
+	}
+}
+
+func TestSyncOnConflictRenameNew(t *testing.T) {
+	assert := assert.New(t)
+	mtime := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	src, dst := tmpDirPath(), tmpDirPath()
+	assert.Nil(writeTree(src, map[string]string{"sub/f": "new"}, mtime.Add(time.Hour)))
+	assert.Nil(writeTree(dst, map[string]string{"sub/f": "old"}, mtime))
+
+	report, err := Sync(src, dst, SyncOptions{Delete: true, Options: Options{OnConflict: func(src, dst os.FileInfo) (Decision, error) {
+		return RenameNew, nil
+	}}})
+	assert.Nil(err)
+	assert.Equal(SyncReport{Created: []string{"sub/f-1"}, Skipped: []string{"sub/f"}}, report)
+	assert.Equal(map[string]string{"./": "", "sub/": "", "sub/f": "old", "sub/f-1": "new"}, snapshot(dst))
+	info, err := os.Stat(filepath.Join(dst, "sub", "f"))
+	assert.Nil(err)
+	assert.True(info.ModTime().Equal(mtime), "the kept dst should not be touched")
+	info, err = os.Stat(filepath.Join(dst, "sub", "f-1"))
+	assert.Nil(err)
+	assert.True(info.ModTime().Equal(mtime.Add(time.Hour)))
+}
+
+func TestSyncDeleteKeepsWhatItWrote(t *testing.T) {
+	assert := assert.New(t)
+	mtime := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name      string
+		opts      Options
+		dst       map[string]string
+		expectDst map[string]string
+	}{
+		{
+			name:      "simple_backup",
+			opts:      Options{Backup: "simple"},
+			expectDst: map[string]string{"./": "", "a": "new", "a~": "old"},
+		},
+		{
+			name:      "numbered_backup",
+			opts:      Options{Backup: "numbered", Atomic: true},
+			dst:       map[string]string{"a.~1~": "older"},
+			expectDst: map[string]string{"./": "", "a": "new", "a.~1~": "older", "a.~2~": "old"},
+		},
+		{
+			name:      "backup_dir_in_dst",
+			opts:      Options{Backup: "simple", BackupDir: "bkp"},
+			expectDst: map[string]string{"./": "", "a": "new", "bkp/": "", "bkp/a~": "old"},
+		},
+		{
+			name:      "resume_tmp_of_src_file",
+			opts:      Options{Resume: true, Atomic: true},
+			dst:       map[string]string{".b.flop-resume": "partial", "gone": "x"},
+			expectDst: map[string]string{"./": "", "a": "new", ".b.flop-resume": "partial"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src, dst := tmpDirPath(), tmpDirPath()
+			assert.Nil(writeTree(src, map[string]string{"a": "new"}, mtime.Add(time.Hour)))
+			assert.Nil(writeTree(src, map[string]string{"b": "b"}, mtime))
+			assert.Nil(writeTree(dst, map[string]string{"a": "old", "b": "b"}, mtime))
+			assert.Nil(writeTree(dst, tt.dst, mtime))
+			if tt.opts.BackupDir != "" {
+				tt.opts.BackupDir = filepath.Join(dst, tt.opts.BackupDir)
+			}
+			tt.expectDst["b"] = "b"
+
+			_, err := Sync(src, dst, SyncOptions{Options: tt.opts, Delete: true})
+			assert.Nil(err)
+			assert.Equal(tt.expectDst, snapshot(dst))
+		})
+	}
+
+	t.Run("journal", func(t *testing.T) {
+		src, dst := tmpDirPath(), tmpDirPath()
+		assert.Nil(writeTree(src, map[string]string{"a": "new"}, mtime.Add(time.Hour)))
+		assert.Nil(writeTree(dst, map[string]string{"a": "old", "gone": "x"}, mtime))
+		journal := NewJournal()
+
+		report, err := Sync(src, dst, SyncOptions{Options: Options{Journal: journal}, Delete: true})
+		assert.Nil(err)
+		assert.Equal([]string{"gone"}, report.Deleted)
+		assert.Nil(journal.Rollback())
+		assert.Equal(map[string]string{"./": "", "a": "old"}, snapshot(dst))
+	})
+}
+
+func TestDiff(t *testing.T) {
+	assert := assert.New(t)
+	mtime := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	tree := map[string]string{"a.txt": "a", "sub/b.txt": "bb", "empty/": ""}
+	tests := []struct {
+		name      string
+		a         map[string]string
+		b         map[string]string
+		bMtime    time.Time
+		chmod     map[string]os.FileMode
+		opts      DiffOptions
+		expectErr error
+		expected  DiffReport
+	}{
+		{
+			name:     "same",
+			expected: DiffReport{},
+		},
+		{
+			name:     "added",
+			b:        map[string]string{"c.txt": "c", "newdir/x": "x", "newdir/y/z": "z"},
+			expected: DiffReport{{Path: "c.txt", Type: Added}, {Path: "newdir", Type: Added}},
+		},
+		{
+			name:     "removed",
+			a:        map[string]string{"old.txt": "old", "sub/olddir/x": "x"},
+			expected: DiffReport{{Path: "old.txt", Type: Removed}, {Path: "sub/olddir", Type: Removed}},
+		},
+		{
+			name:     "modified_content",
+			b:        map[string]string{"a.txt": "aa"},
+			bMtime:   mtime.Add(time.Hour),
+			expected: DiffReport{{Path: "a.txt", Type: Modified, Changes: []string{"content", "mtime"}}},
+		},
+		{
+			name:     "same_size_without_checksum",
+			b:        map[string]string{"sub/b.txt": "cc"},
+			expected: DiffReport{},
+		},
+		{
+			name:     "checksum",
+			b:        map[string]string{"sub/b.txt": "cc"},
+			opts:     DiffOptions{Checksum: true},
+			expected: DiffReport{{Path: "sub/b.txt", Type: Modified, Changes: []string{"content"}}},
+		},
+		{
+			name:     "mode",
+			chmod:    map[string]os.FileMode{"a.txt": 0600, "empty": 0700},
+			expected: DiffReport{{Path: "a.txt", Type: Modified, Changes: []string{"mode"}}, {Path: "empty", Type: Modified, Changes: []string{"mode"}}},
+		},
+		{
+			name:     "mtime",
+			b:        map[string]string{"a.txt": "a"},
+			bMtime:   mtime.Add(time.Hour),
+			expected: DiffReport{{Path: "a.txt", Type: Modified, Changes: []string{"mtime"}}},
+		},
+		{
+			name:     "ignore_mtime",
+			b:        map[string]string{"a.txt": "a"},
+			bMtime:   mtime.Add(time.Hour),
+			opts:     DiffOptions{IgnoreModTime: true},
+			expected: DiffReport{},
+		},
+		{
+			name:     "type_changed",
+			a:        map[string]string{"c/x": "x"},
+			b:        map[string]string{"c": "c"},
+			expected: DiffReport{{Path: "c", Type: TypeChanged, From: "directory", To: "file"}},
+		},
+		{
+			name:     "exclude",
+			a:        map[string]string{"old.tmp": "old"},
+			b:        map[string]string{"a.txt": "aa", "cache/x.tmp": "x"},
+			opts:     DiffOptions{Exclude: []string{"*.tmp", "a.txt"}},
+			expected: DiffReport{{Path: "cache", Type: Added}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, b := tmpDirPath(), tmpDirPath()
+			assert.Nil(writeTree(a, tree, mtime))
+			assert.Nil(writeTree(a, tt.a, mtime))
+			assert.Nil(writeTree(b, tree, mtime))
+			if tt.bMtime.IsZero() {
+				tt.bMtime = mtime
+			}
+			assert.Nil(writeTree(b, tt.b, tt.bMtime))
+			for name, mode := range tt.chmod {
+				assert.Nil(os.Chmod(filepath.Join(b, name), mode))
+			}
+
+			report, err := Diff(a, b, tt.opts)
+			assert.Equal(tt.expectErr, errors.Cause(err))
+			assert.Equal(tt.expected, report)
+		})
+	}
+
+	_, err := Diff(tmpDirPath(), tmpDirPathUnused(), DiffOptions{})
+	assert.True(stderrors.Is(err, ErrFileNotExist))
+}
+
+func TestDiffReportOutput(t *testing.T) {
+	assert := assert.New(t)
+	report := DiffReport{
+		{Path: "a.txt", Type: Modified, Changes: []string{"content", "mtime"}},
+		{Path: "c", Type: TypeChanged, From: "directory", To: "file"},
+		{Path: "new", Type: Added},
+		{Path: "old", Type: Removed},
+	}
+
+	var text bytes.Buffer
+	assert.Nil(report.WriteText(&text))
+	assert.Equal("M a.txt (content, mtime)\nT c (directory -> file)\nA new\nD old\n", text.String())
+
+	var out bytes.Buffer
+	assert.Nil(report.WriteJSON(&out))
+	var decoded DiffReport
+	assert.Nil(json.Unmarshal(out.Bytes(), &decoded))
+	assert.Equal(report, decoded)
+	assert.Contains(out.String(), `"type": "type-changed"`)
+
+	out.Reset()
+	assert.Nil(DiffReport(nil).WriteJSON(&out))
+	assert.Equal("[]\n", out.String())
+}
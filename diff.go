@@ -0,0 +1,239 @@
+package flop
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// DiffOptions determine how Diff compares two trees.
+type DiffOptions struct {
+	// Exclude are patterns for entries which are not compared, matched like SyncOptions.Exclude.
+	Exclude []string
+	// Checksum will compare regular files of the same size by SHA-256 checksum.  Without it only their size is
+	// compared for content, and a change of the same size is seen as a change of modification time.
+	Checksum bool
+	// IgnoreModTime will not report entries whose only difference is the modification time.
+	IgnoreModTime bool
+	// IgnoreOwner will not compare the owner and group of entries.  Owners are never compared on Windows.
+	IgnoreOwner bool
+}
+
+// DiffType is the kind of difference found by Diff.
+type DiffType string
+
+const (
+	// Added entries are only in the new tree.
+	Added DiffType = "added"
+	// Removed entries are only in the old tree.
+	Removed DiffType = "removed"
+	// Modified entries are in both trees and differ in content, mode, modification time, owner or link target.
+	Modified DiffType = "modified"
+	// TypeChanged entries are in both trees with different types, like a file replaced by a directory.
+	TypeChanged DiffType = "type-changed"
+)
+
+// Difference is an entry which differs between two trees.
+type Difference struct {
+	// Path is slash separated and relative to the roots of the trees, with "." for the roots themselves.
+	Path string `json:"path"`
+	// Type is the kind of difference.
+	Type DiffType `json:"type"`
+	// Changes lists what differs in a Modified entry, any of "content", "mode", "mtime", "owner" and "target".
+	Changes []string `json:"changes,omitempty"`
+	// From and To are the type of a TypeChanged entry in the old and new tree, like "file" or "directory".
+	From string `json:"from,omitempty"`
+	To   string `json:"to,omitempty"`
+}
+
+// DiffReport lists the differences between two trees, sorted by path.  Only the top entry of an added or
+// removed directory is listed.
+type DiffReport []Difference
+
+// Diff compares the tree at a, the old tree, with the tree at b, the new tree.  Symbolic links are compared
+// by their target and never followed, like Copy does, and special files by their type, mode, modification
+// time and owner, as they have no content.  Directories are only compared by mode and owner, as their
+// modification time changes with their entries.
+func Diff(a, b string, opts DiffOptions) (DiffReport, error) {
+	report := DiffReport{}
+	for _, root := range []string{a, b} {
+		if _, err := os.Lstat(root); err != nil {
+			if os.IsNotExist(err) {
+				return report, &Error{Op: "diff", Src: a, Dst: b, Kind: ErrFileNotExist}
+			}
+			return report, &Error{Op: "stat", Src: root, Kind: ErrCannotStatFile, Err: err}
+		}
+	}
+
+	err := filepath.Walk(a, func(aPath string, aInfo os.FileInfo, err error) error {
+		if err != nil {
+			return &Error{Op: "readdir", Src: aPath, Kind: ErrReadingSrcDir, Err: err}
+		}
+		rel, err := filepath.Rel(a, aPath)
+		if err != nil {
+			return err
+		}
+		if rel != "." && matchesAny(opts.Exclude, rel) {
+			return skipEntry(aInfo)
+		}
+		bPath := filepath.Join(b, rel)
+		bInfo, err := os.Lstat(bPath)
+		if os.IsNotExist(err) {
+			report = append(report, Difference{Path: filepath.ToSlash(rel), Type: Removed})
+			return skipEntry(aInfo)
+		}
+		if err != nil {
+			return &Error{Op: "stat", Src: bPath, Kind: ErrCannotStatFile, Err: err}
+		}
+		if fileType(aInfo) != fileType(bInfo) {
+			report = append(report, Difference{
+				Path: filepath.ToSlash(rel),
+				Type: TypeChanged,
+				From: typeName(aInfo),
+				To:   typeName(bInfo),
+			})
+			// the entries of a replaced directory are not compared
+			return skipEntry(aInfo)
+		}
+		changes, err := opts.changes(aPath, bPath, aInfo, bInfo)
+		if err != nil {
+			return &Error{Op: "diff", Src: aPath, Dst: bPath, Kind: ErrCannotOpenSrc, Err: err}
+		}
+		if len(changes) > 0 {
+			report = append(report, Difference{Path: filepath.ToSlash(rel), Type: Modified, Changes: changes})
+		}
+		return nil
+	})
+	if err != nil {
+		return report, err
+	}
+
+	err = filepath.Walk(b, func(bPath string, bInfo os.FileInfo, err error) error {
+		if err != nil {
+			return &Error{Op: "readdir", Src: bPath, Kind: ErrReadingSrcDir, Err: err}
+		}
+		rel, err := filepath.Rel(b, bPath)
+		if err != nil || rel == "." {
+			return err
+		}
+		if matchesAny(opts.Exclude, rel) {
+			return skipEntry(bInfo)
+		}
+		aInfo, err := os.Lstat(filepath.Join(a, rel))
+		if os.IsNotExist(err) {
+			report = append(report, Difference{Path: filepath.ToSlash(rel), Type: Added})
+			return skipEntry(bInfo)
+		}
+		if err == nil && fileType(aInfo) != fileType(bInfo) {
+			// already reported as a type change
+			return skipEntry(bInfo)
+		}
+		return nil
+	})
+	sort.Slice(report, func(i, j int) bool { return report[i].Path < report[j].Path })
+	return report, err
+}
+
+// changes returns what differs between two entries of the same type.
+func (o *DiffOptions) changes(aPath, bPath string, aInfo, bInfo os.FileInfo) ([]string, error) {
+	var changes []string
+	switch {
+	case aInfo.Mode().IsRegular():
+		same := aInfo.Size() == bInfo.Size()
+		if same && o.Checksum {
+			var err error
+			if same, err = sameContent(aPath, bPath, aInfo.Size()); err != nil {
+				return nil, err
+			}
+		}
+		if !same {
+			changes = append(changes, "content")
+		}
+	case aInfo.Mode()&os.ModeSymlink != 0:
+		aLink, err := os.Readlink(aPath)
+		if err != nil {
+			return nil, err
+		}
+		bLink, err := os.Readlink(bPath)
+		if err != nil {
+			return nil, err
+		}
+		if aLink != bLink {
+			changes = append(changes, "target")
+		}
+	}
+	// the mode of a symbolic link is not used
+	if aInfo.Mode()&os.ModeSymlink == 0 && aInfo.Mode().Perm() != bInfo.Mode().Perm() {
+		changes = append(changes, "mode")
+	}
+	if !o.IgnoreModTime && !aInfo.IsDir() && !aInfo.ModTime().Equal(bInfo.ModTime()) {
+		changes = append(changes, "mtime")
+	}
+	if !o.IgnoreOwner {
+		aUID, aGID, aOK := fileOwner(aInfo)
+		bUID, bGID, bOK := fileOwner(bInfo)
+		if aOK && bOK && (aUID != bUID || aGID != bGID) {
+			changes = append(changes, "owner")
+		}
+	}
+	return changes, nil
+}
+
+// typeName returns a name for the type of the entry described by info.
+func typeName(info os.FileInfo) string {
+	mode := info.Mode()
+	switch {
+	case mode.IsDir():
+		return "directory"
+	case mode&os.ModeSymlink != 0:
+		return "symlink"
+	case mode&os.ModeNamedPipe != 0:
+		return "named pipe"
+	case mode&os.ModeSocket != 0:
+		return "socket"
+	case mode&(os.ModeDevice|os.ModeCharDevice) != 0:
+		return "device"
+	default:
+		return "file"
+	}
+}
+
+// diffSymbols are the symbols WriteText starts each line with.
+var diffSymbols = map[DiffType]string{
+	Added:       "A",
+	Removed:     "D",
+	Modified:    "M",
+	TypeChanged: "T",
+}
+
+// WriteText writes the report for people to read, one line per difference like "M docs/a.txt (content, mtime)".
+// Lines start with A for added, D for removed, M for modified and T for type changed entries.
+func (r DiffReport) WriteText(w io.Writer) error {
+	for _, d := range r {
+		line := diffSymbols[d.Type] + " " + d.Path
+		switch d.Type {
+		case Modified:
+			line += " (" + strings.Join(d.Changes, ", ") + ")"
+		case TypeChanged:
+			line += " (" + d.From + " -> " + d.To + ")"
+		}
+		if _, err := fmt.Fprintln(w, line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteJSON writes the report as an indented JSON array of differences.  An empty report is written as [].
+func (r DiffReport) WriteJSON(w io.Writer) error {
+	if r == nil {
+		r = DiffReport{}
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
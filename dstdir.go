@@ -0,0 +1,155 @@
+package flop
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+// dstDir is the directory a destination file is written in.  See openDstDir.
+type dstDir struct {
+	// path is the path the directory was opened with.
+	path string
+	// fd is the open directory.  It is nil on platforms where the directory is used by path.
+	fd *os.File
+	// opts are the Options of the copy.
+	opts Options
+}
+
+// close releases the directory.
+func (d *dstDir) close() {
+	if d.fd != nil {
+		if err := d.fd.Close(); err != nil {
+			d.opts.logDebug("err closing dir", "dir", d.path, "err", err)
+		}
+	}
+}
+
+// verify returns ErrFileChanged unless the entry for dstFile is still the file found when dstFile was
+// initialized, or is still missing if it did not exist.
+func (d *dstDir) verify(dstFile *File) error {
+	name := filepath.Base(dstFile.Path)
+	var expect os.FileInfo
+	if dstFile.existOnInit {
+		expect = dstFile.fileInfoOnInit
+	}
+	same, err := d.same(name, expect)
+	if err != nil {
+		return err
+	}
+	if !same {
+		return &Error{Op: "open", Dst: dstFile.Path, Kind: ErrFileChanged}
+	}
+	return nil
+}
+
+// create opens the destination dstFile for writing.  A missing destination is created exclusively and an
+// existing destination must be the same file found when dstFile was initialized, so a file swapped in after
+// the check is never written to.  The existing content is only truncated once the opened file is verified.
+// With Options.ConfineTo an existing symbolic link is refused with ErrPathEscapesRoot.
+func (d *dstDir) create(dstFile *File) (*os.File, error) {
+	name := filepath.Base(dstFile.Path)
+	if !dstFile.existOnInit {
+		fd, err := d.open(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666, false)
+		if os.IsExist(errors.Cause(err)) {
+			return nil, &Error{Op: "create", Dst: dstFile.Path, Kind: ErrFileChanged, Err: err}
+		}
+		return fd, err
+	}
+
+	fd, err := d.openExisting(dstFile)
+	if err != nil {
+		return nil, err
+	}
+	if err := fd.Truncate(0); err != nil {
+		_ = fd.Close()
+		return nil, err
+	}
+	return fd, nil
+}
+
+// openExisting opens the existing destination dstFile for writing without truncating it, once it is verified
+// to be the same file found when dstFile was initialized.  See create.
+func (d *dstDir) openExisting(dstFile *File) (*os.File, error) {
+	name := filepath.Base(dstFile.Path)
+	// a destination that was a symbolic link when checked is written through, like cp does, unless confined
+	if dstFile.isSymlink() && d.opts.ConfineTo != "" {
+		return nil, &Error{Op: "open", Dst: dstFile.Path, Kind: ErrPathEscapesRoot, Err: errors.Errorf("symbolic link, root %s", d.opts.ConfineTo)}
+	}
+	follow := dstFile.isSymlink()
+	fd, err := d.open(name, os.O_RDWR, 0666, follow)
+	if err != nil {
+		if os.IsNotExist(errors.Cause(err)) || d.isLoop(err) {
+			return nil, &Error{Op: "open", Dst: dstFile.Path, Kind: ErrFileChanged, Err: err}
+		}
+		return nil, err
+	}
+	if !follow {
+		info, err := fd.Stat()
+		if err != nil {
+			_ = fd.Close()
+			return nil, err
+		}
+		if !os.SameFile(info, dstFile.fileInfoOnInit) {
+			_ = fd.Close()
+			return nil, &Error{Op: "open", Dst: dstFile.Path, Kind: ErrFileChanged}
+		}
+	}
+	return fd, nil
+}
+
+// createTemp creates a new temporary file in the directory whose name begins with prefix, like
+// ioutil.TempFile.
+func (d *dstDir) createTemp(prefix string) (*os.File, error) {
+	for i := 0; i < 10000; i++ {
+		name := prefix + strconv.Itoa(int(rand.Uint32()))
+		fd, err := d.open(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600, false)
+		if os.IsExist(errors.Cause(err)) {
+			continue
+		}
+		return fd, err
+	}
+	return nil, &os.PathError{Op: "createtemp", Path: filepath.Join(d.path, prefix+"*"), Err: os.ErrExist}
+}
+
+// verifyRenamed returns ErrFileChanged unless the entry name is the file tmp, which was just renamed to it.
+// A mismatch means the directory was swapped after it was opened, and the rename landed somewhere else.
+func (d *dstDir) verifyRenamed(name string, tmp os.FileInfo) error {
+	same, err := d.same(name, tmp)
+	if err != nil {
+		return err
+	}
+	if !same {
+		return &Error{Op: "rename", Dst: filepath.Join(d.path, name), Kind: ErrFileChanged, Err: errors.Errorf("directory %s was replaced", d.path)}
+	}
+	return nil
+}
+
+// makeTemp calls create with unused temporary names next to name, like unusedTemp, until one does not exist
+// yet, and returns the name it succeeded with.
+func (d *dstDir) makeTemp(name string, create func(tmp string) error) (string, error) {
+	for i := 0; ; i++ {
+		tmp := fmt.Sprintf("%s.tmp-%d-%d", name, os.Getpid(), i)
+		err := create(tmp)
+		if err == nil {
+			return tmp, nil
+		}
+		if !os.IsExist(err) {
+			return "", err
+		}
+	}
+}
+
+// openParent opens the directory path is created in with openDstDir.  A failure other than
+// ErrPathEscapesRoot is returned as ErrCannotOpenOrCreateDstFile.
+func openParent(path string, opts Options) (*dstDir, error) {
+	dir, err := openDstDir(filepath.Dir(path), opts)
+	if err != nil && errors.Cause(err) != ErrPathEscapesRoot {
+		return nil, &Error{Op: "open", Dst: filepath.Dir(path), Kind: ErrCannotOpenOrCreateDstFile, Err: err}
+	}
+	return dir, err
+}
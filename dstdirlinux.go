@@ -0,0 +1,138 @@
+// +build linux
+
+package flop
+
+import (
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// openDstDir opens the directory dir so the destination in it can be checked, created and verified through
+// a single file descriptor with openat and fstatat, even if the path to dir is swapped for a symbolic link
+// part way through.  With Options.ConfineTo the directory is opened with openat2 beneath ConfineTo.
+func openDstDir(dir string, opts Options) (*dstDir, error) {
+	fd := -1
+	if opts.ConfineTo != "" {
+		rel, err := opts.confinedRel(dir)
+		if err != nil {
+			return nil, err
+		}
+		fd, err = openBeneath(opts.ConfineTo, rel, unix.O_PATH|unix.O_DIRECTORY, 0)
+		if err == unix.ENOSYS {
+			if err := confineDirByPath(dir, opts); err != nil {
+				return nil, err
+			}
+		} else if err != nil {
+			return nil, escapeErr(dir, err, opts)
+		}
+	}
+	if fd < 0 {
+		var err error
+		fd, err = unix.Open(dir, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+		if err != nil {
+			return nil, &os.PathError{Op: "open", Path: dir, Err: err}
+		}
+	}
+	return &dstDir{path: dir, fd: os.NewFile(uintptr(fd), dir), opts: opts}, nil
+}
+
+// open opens name in the directory with openat.  Symbolic links are only followed when follow is true.
+func (d *dstDir) open(name string, flag int, perm os.FileMode, follow bool) (*os.File, error) {
+	flag |= unix.O_CLOEXEC
+	if !follow {
+		flag |= unix.O_NOFOLLOW
+	}
+	for {
+		fd, err := unix.Openat(int(d.fd.Fd()), name, flag, uint32(perm.Perm()))
+		if err == nil {
+			return os.NewFile(uintptr(fd), d.path+string(os.PathSeparator)+name), nil
+		}
+		if err != unix.EINTR {
+			return nil, &os.PathError{Op: "openat", Path: d.path + string(os.PathSeparator) + name, Err: err}
+		}
+	}
+}
+
+// same returns true if the entry name in the directory is the file described by info, found with fstatat
+// without following symbolic links.  A nil info is the same as a missing entry.
+func (d *dstDir) same(name string, info os.FileInfo) (bool, error) {
+	var st unix.Stat_t
+	err := unix.Fstatat(int(d.fd.Fd()), name, &st, unix.AT_SYMLINK_NOFOLLOW)
+	if err == unix.ENOENT {
+		return info == nil, nil
+	}
+	if err != nil {
+		return false, &os.PathError{Op: "fstatat", Path: d.path + string(os.PathSeparator) + name, Err: err}
+	}
+	if info == nil {
+		return false, nil
+	}
+	sys, ok := info.Sys().(*syscall.Stat_t)
+	return ok && uint64(sys.Dev) == uint64(st.Dev) && uint64(sys.Ino) == uint64(st.Ino), nil
+}
+
+// isLoop returns true if err is from opening a symbolic link without following it.
+func (d *dstDir) isLoop(err error) bool {
+	if pathErr, ok := err.(*os.PathError); ok {
+		return pathErr.Err == unix.ELOOP
+	}
+	return false
+}
+
+// remove removes the entry name from the directory with unlinkat.
+func (d *dstDir) remove(name string) error {
+	if err := unix.Unlinkat(int(d.fd.Fd()), name, 0); err != nil {
+		return &os.PathError{Op: "unlinkat", Path: d.path + string(os.PathSeparator) + name, Err: err}
+	}
+	return nil
+}
+
+// mkdir creates the directory name in the directory with mkdirat.
+func (d *dstDir) mkdir(name string, perm os.FileMode) error {
+	if err := unix.Mkdirat(int(d.fd.Fd()), name, uint32(perm.Perm())); err != nil {
+		return &os.PathError{Op: "mkdirat", Path: d.path + string(os.PathSeparator) + name, Err: err}
+	}
+	return nil
+}
+
+// link creates name in the directory as a hard link to the file at oldpath with linkat.
+func (d *dstDir) link(oldpath, name string) error {
+	if err := unix.Linkat(unix.AT_FDCWD, oldpath, int(d.fd.Fd()), name, 0); err != nil {
+		return &os.LinkError{Op: "linkat", Old: oldpath, New: d.path + string(os.PathSeparator) + name, Err: err}
+	}
+	return nil
+}
+
+// symlink creates name in the directory as a symbolic link to target with symlinkat.
+func (d *dstDir) symlink(target, name string) error {
+	if err := unix.Symlinkat(target, int(d.fd.Fd()), name); err != nil {
+		return &os.LinkError{Op: "symlinkat", Old: target, New: d.path + string(os.PathSeparator) + name, Err: err}
+	}
+	return nil
+}
+
+// mknod creates name in the directory with mknodat as the named pipe, device node or socket described by
+// info.
+func (d *dstDir) mknod(info os.FileInfo, name string) error {
+	path := d.path + string(os.PathSeparator) + name
+	mode, dev, err := specialNode(info)
+	if err == nil {
+		err = unix.Mknodat(int(d.fd.Fd()), name, mode, dev)
+	}
+	if err != nil {
+		return &os.PathError{Op: "mknodat", Path: path, Err: err}
+	}
+	return nil
+}
+
+// rename renames the entry oldname in the directory to newname with renameat.
+func (d *dstDir) rename(oldname, newname string) error {
+	fd := int(d.fd.Fd())
+	if err := unix.Renameat(fd, oldname, fd, newname); err != nil {
+		prefix := d.path + string(os.PathSeparator)
+		return &os.LinkError{Op: "renameat", Old: prefix + oldname, New: prefix + newname, Err: err}
+	}
+	return nil
+}
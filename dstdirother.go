@@ -0,0 +1,82 @@
+// +build !linux
+
+package flop
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// openDstDir returns the directory dir.  Without openat the destination in it is checked, created and
+// verified by path, so a swap is only detected after the fact.
+func openDstDir(dir string, opts Options) (*dstDir, error) {
+	if err := confineDir(dir, opts); err != nil {
+		return nil, err
+	}
+	return &dstDir{path: dir, opts: opts}, nil
+}
+
+// open opens name in the directory.  A symbolic link is refused unless follow is true.
+func (d *dstDir) open(name string, flag int, perm os.FileMode, follow bool) (*os.File, error) {
+	path := filepath.Join(d.path, name)
+	if !follow {
+		if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSymlink != 0 {
+			return nil, &os.PathError{Op: "open", Path: path, Err: errSymlink}
+		}
+	}
+	return os.OpenFile(path, flag, perm)
+}
+
+// same returns true if the entry name in the directory is the file described by info, without following
+// symbolic links.  A nil info is the same as a missing entry.
+func (d *dstDir) same(name string, info os.FileInfo) (bool, error) {
+	current, err := os.Lstat(filepath.Join(d.path, name))
+	if os.IsNotExist(err) {
+		return info == nil, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return info != nil && os.SameFile(current, info), nil
+}
+
+// errSymlink is returned by open for a symbolic link that should not be followed.
+var errSymlink = errors.New("is a symbolic link")
+
+// isLoop returns true if err is from opening a symbolic link without following it.
+func (d *dstDir) isLoop(err error) bool {
+	pathErr, ok := err.(*os.PathError)
+	return ok && pathErr.Err == errSymlink
+}
+
+// remove removes the entry name from the directory.
+func (d *dstDir) remove(name string) error {
+	return os.Remove(filepath.Join(d.path, name))
+}
+
+// mkdir creates the directory name in the directory.
+func (d *dstDir) mkdir(name string, perm os.FileMode) error {
+	return os.Mkdir(filepath.Join(d.path, name), perm)
+}
+
+// link creates name in the directory as a hard link to the file at oldpath.
+func (d *dstDir) link(oldpath, name string) error {
+	return os.Link(oldpath, filepath.Join(d.path, name))
+}
+
+// symlink creates name in the directory as a symbolic link to target.
+func (d *dstDir) symlink(target, name string) error {
+	return os.Symlink(target, filepath.Join(d.path, name))
+}
+
+// mknod creates name in the directory as the named pipe, device node or socket described by info.
+func (d *dstDir) mknod(info os.FileInfo, name string) error {
+	return makeSpecial(info, filepath.Join(d.path, name))
+}
+
+// rename renames the entry oldname in the directory to newname.
+func (d *dstDir) rename(oldname, newname string) error {
+	return os.Rename(filepath.Join(d.path, oldname), filepath.Join(d.path, newname))
+}
@@ -0,0 +1,105 @@
+package flop
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// syncDir flushes the entries of a directory to stable storage.  It is a variable so tests can simulate
+// crashes.
+var syncDir = fsyncDir
+
+// syncParent syncs the directory containing path when Options.Durable is set, so a new or renamed entry at
+// path survives a crash.
+func syncParent(path string, opts Options) error {
+	return durableSync(filepath.Dir(filepath.Clean(path)), opts)
+}
+
+// durableSync syncs the directory dir when Options.Durable is set.
+func durableSync(dir string, opts Options) error {
+	if !opts.Durable {
+		return nil
+	}
+	opts.logDebug("syncing dir", "dir", dir)
+	if err := syncDir(dir); err != nil {
+		return &Error{Op: "sync", Dst: dir, Kind: ErrCannotSyncDir, Err: err}
+	}
+	return nil
+}
+
+// mkdirAll calls os.MkdirAll, recording each directory it creates in Options.Journal and calling
+// Hooks.OnMkdir for it.  With Options.Durable the parent of each created directory is synced, top down, so the
+// whole path survives a crash.  With Options.ConfineTo each directory is created through its confined
+// parent, see mkdirBeneath.
+func mkdirAll(path string, perm os.FileMode, opts Options) error {
+	if err := confineDir(path, opts); err != nil {
+		return err
+	}
+	if opts.ConfineTo == "" && opts.Journal == nil && !opts.Durable && opts.Hooks.OnMkdir == nil {
+		return os.MkdirAll(path, perm)
+	}
+
+	// find the missing directories, from the top down
+	var missing []string
+	for p := filepath.Clean(path); ; p = filepath.Dir(p) {
+		if _, err := os.Lstat(p); !os.IsNotExist(err) {
+			break
+		}
+		missing = append([]string{p}, missing...)
+		if filepath.Dir(p) == p {
+			break
+		}
+	}
+
+	var created []string
+	var err error
+	if opts.ConfineTo != "" {
+		created, err = mkdirBeneath(missing, perm, opts)
+	} else {
+		err = os.MkdirAll(path, perm)
+		for _, dir := range missing {
+			if _, statErr := os.Lstat(dir); statErr == nil {
+				created = append(created, dir)
+			}
+		}
+	}
+	opts.Journal.recordDirs(created)
+	for _, dir := range created {
+		opts.Hooks.onMkdir(dir)
+	}
+	if err != nil {
+		return err
+	}
+	for _, dir := range created {
+		if err := syncParent(dir, opts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mkdirBeneath creates each of the missing directories, from the top down, with mkdirat in its parent opened
+// by openDstDir, so a parent swapped for a symbolic link after it was checked is refused rather than followed
+// out of Options.ConfineTo.  It returns the directories it created.
+func mkdirBeneath(missing []string, perm os.FileMode, opts Options) ([]string, error) {
+	var created []string
+	for _, dir := range missing {
+		parent, err := openDstDir(filepath.Dir(dir), opts)
+		if err != nil {
+			return created, err
+		}
+		err = parent.mkdir(filepath.Base(dir), perm)
+		parent.close()
+		if os.IsExist(err) {
+			// made by someone else in the meantime, like os.MkdirAll it only has to be a directory
+			if info, statErr := os.Lstat(dir); statErr == nil && info.IsDir() {
+				continue
+			}
+		}
+		if err != nil {
+			return created, err
+		}
+		created = append(created, dir)
+	}
+	return created, nil
+}
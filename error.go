@@ -1,6 +1,11 @@
 package flop
 
-import "github.com/pkg/errors"
+import (
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
 
 var (
 	// ErrFileNotExist occurs when a file is given that does not exist when its existence is required.
@@ -30,5 +35,94 @@ var (
 	// See AppendNameToPath option for a more dynamic approach.
 	ErrWritingFileToExistingDir = errors.New("cannot overwrite existing directory with file")
 	// ErrInvalidBackupControlValue occurs when a control value is given to the Backup option, but the value is invalid.
-	ErrInvalidBackupControlValue = errors.New("invalid backup value, valid values are 'off', 'simple', 'existing', 'numbered'")
+	ErrInvalidBackupControlValue = errors.New("invalid backup value, valid values are 'off', 'simple', 'existing', 'numbered', 'timestamp', 'env' or their aliases 'none', 'never', 'nil', 't'")
+	// ErrUnknownBucket occurs when an s3:// path names a bucket that is not present in Options.ObjectStores.
+	ErrUnknownBucket = errors.New("bucket is not configured in Options.ObjectStores")
+	// ErrObjectToObject occurs when both src and dst are object store paths.
+	ErrObjectToObject = errors.New("copying between object store paths is not supported")
+	// ErrObjectExists occurs when a conditional write to an object store finds the key already exists.
+	ErrObjectExists = errors.New("object already exists")
+	// ErrUnsafeObjectKey occurs when a downloaded object key is absolute or has a ".." element, and so would be
+	// written outside of the destination.
+	ErrUnsafeObjectKey = errors.New("object key would be written outside of the destination")
+	// ErrMissingSrc occurs when CopyMany is not given any sources.
+	ErrMissingSrc = errors.New("missing source file operand")
+	// ErrTargetNotDir occurs when CopyMany requires the destination to be an existing directory but it is not.
+	ErrTargetNotDir = errors.New("target is not a directory")
+	// ErrTooManySrcs occurs when more than one source is given with Options.NoTargetDirectory.
+	ErrTooManySrcs = errors.New("with Options.NoTargetDirectory, only one source may be given")
+	// ErrTargetDirectoryConflict occurs when both Options.TargetDirectory and Options.NoTargetDirectory are set.
+	ErrTargetDirectoryConflict = errors.New("cannot combine Options.TargetDirectory and Options.NoTargetDirectory")
+	// ErrCannotSyncDir occurs when Options.Durable is set and a destination directory cannot be synced.
+	ErrCannotSyncDir = errors.New("cannot sync directory")
+	// ErrPathEscapesRoot occurs when Options.ConfineTo is set and a destination lies outside of it, or can only
+	// be reached through a symbolic link.
+	ErrPathEscapesRoot = errors.New("path escapes confining root")
+	// ErrFileChanged occurs when a source or destination file is replaced between being checked and being used.
+	ErrFileChanged = errors.New("file was replaced while being copied")
+	// ErrSpecialFile occurs when the source is a named pipe, device node or socket and Options.CopySpecial is
+	// not set.
+	ErrSpecialFile = errors.New("source is a special file")
+	// ErrConflictAborted occurs when Options.OnConflict decides to Abort, or returns an unknown Decision.
+	ErrConflictAborted = errors.New("copy aborted on conflicting destination")
+	// ErrCannotDeleteDst occurs when Sync cannot remove a destination entry.
+	ErrCannotDeleteDst = errors.New("cannot delete destination entry")
 )
+
+// Error describes a failed operation on a file.  Each failure described by one of the sentinel errors above is
+// returned as an *Error, whose Kind is the sentinel error and whose Err is the underlying error, like an
+// *os.PathError, so both errors.Is(err, ErrCannotOpenSrc) and errors.Is(err, os.ErrPermission) work.
+// errors.Cause from github.com/pkg/errors returns Kind.  Other failures, like reading or writing the content of
+// a file, and errors returned by Hooks or Options.OnConflict, are returned as they are.
+type Error struct {
+	// Op is the operation that failed, like "open", "create", "rename" or "chmod".
+	Op string
+	// Src is the source path of the operation, if it has one.
+	Src string
+	// Dst is the destination path of the operation, if it has one.
+	Dst string
+	// Kind is the sentinel error describing the failure.
+	Kind error
+	// Err is the underlying error, usually from the os package.  It may be nil.
+	Err error
+}
+
+// Error returns the operation, its paths, the Kind of failure and the underlying error, like
+// "open src.txt: source file cannot be opened: permission denied".
+func (e *Error) Error() string {
+	var b strings.Builder
+	b.WriteString(e.Op)
+	for _, path := range []string{e.Src, e.Dst} {
+		if path != "" {
+			b.WriteString(" " + path)
+		}
+	}
+	b.WriteString(": " + e.Kind.Error())
+	// the operation and paths of os errors would repeat the ones above
+	err := e.Err
+	switch osErr := err.(type) {
+	case *os.PathError:
+		err = osErr.Err
+	case *os.LinkError:
+		err = osErr.Err
+	}
+	if err != nil {
+		b.WriteString(": " + err.Error())
+	}
+	return b.String()
+}
+
+// Unwrap returns the underlying error.
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Is returns true if target is the Kind of the error.
+func (e *Error) Is(target error) bool {
+	return target == e.Kind
+}
+
+// Cause returns the Kind of the error, for errors.Cause from github.com/pkg/errors.
+func (e *Error) Cause() error {
+	return e.Kind
+}
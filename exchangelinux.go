@@ -0,0 +1,18 @@
+// +build linux
+
+package flop
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+// exchange atomically swaps the directories at stage and dst with renameat2(RENAME_EXCHANGE), falling back
+// to renaming dst aside when the filesystem does not support it.  The old dst is left at stage.
+func exchange(stage, dst string, opts Options) error {
+	err := unix.Renameat2(unix.AT_FDCWD, stage, unix.AT_FDCWD, dst, unix.RENAME_EXCHANGE)
+	if err == unix.ENOSYS || err == unix.EINVAL {
+		opts.logDebug("renameat2 exchange is not supported, renaming dst aside", "dst", dst, "err", err)
+		return renameAside(stage, dst)
+	}
+	return err
+}
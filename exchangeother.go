@@ -0,0 +1,10 @@
+// +build !linux
+
+package flop
+
+// exchange swaps the directories at stage and dst by renaming dst aside, as an atomic exchange is only
+// available on Linux.  The old dst is left at stage.
+func exchange(stage, dst string, opts Options) error {
+	opts.logDebug("renaming dst aside to swap in staging dir", "dst", dst, "stage", stage)
+	return renameAside(stage, dst)
+}
@@ -8,4 +8,5 @@ require (
 	github.com/pmezard/go-difflib v1.0.0 // indirect
 	github.com/rs/zerolog v1.11.0
 	github.com/stretchr/testify v1.2.2
+	golang.org/x/sys v0.0.0-20210616094352-59db8d763f22
 )
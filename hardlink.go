@@ -0,0 +1,112 @@
+package flop
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// inode identifies a file by device and inode number.
+type inode struct {
+	dev, ino uint64
+}
+
+// hardLinks tracks source files with more than one link that were copied by copyDir, so later links to the
+// same file can be recreated as hard links to the first copy.  It is shared by every recursive call.
+type hardLinks struct {
+	mu     sync.Mutex
+	copies map[inode]string
+}
+
+// firstCopy returns the destination of the first copy of the source file described by info, if one has been
+// made.
+func (h *hardLinks) firstCopy(info os.FileInfo) (string, bool) {
+	key, ok := linkedInode(info)
+	if !ok {
+		return "", false
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	first, ok := h.copies[key]
+	return first, ok
+}
+
+// copied records dst as the first copy of the source file described by info, once its content has been
+// written there.  A destination kept by NoClobber or OnConflict is never recorded, it holds other content.
+// It is a noop on a nil hardLinks, or when a first copy is already recorded.
+func (h *hardLinks) copied(info os.FileInfo, dst string) {
+	if h == nil {
+		return
+	}
+	key, ok := linkedInode(info)
+	if !ok {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.copies[key]; !ok {
+		h.copies[key] = dst
+	}
+}
+
+// linkToCopy creates dst as a hard link to first, the copy of an earlier link to the same source file described
+// by srcInfo.  An existing dst is handled like copyFile does, and is replaced with a rename so it is never
+// missing.
+func linkToCopy(first, dst string, srcInfo os.FileInfo, opts Options) error {
+	dstFile := NewFile(dst)
+	_ = dstFile.setInfo()
+	if dstFile.existOnInit {
+		if dstFile.isDir {
+			return &Error{Op: "link", Src: first, Dst: dstFile.Path, Kind: ErrWritingFileToExistingDir}
+		}
+		if info, err := os.Lstat(first); err == nil && os.SameFile(dstFile.fileInfoOnInit, info) {
+			opts.logDebug("dst is already linked to first copy", "dst", dst, "first", first)
+			return nil
+		}
+	}
+	var err error
+	if dstFile, opts, err = resolveConflict(first, srcInfo, dstFile, opts); err != nil || dstFile == nil {
+		return err
+	}
+	dst = dstFile.Path
+	if err := opts.Hooks.beforeCopy(first, dst); err != nil {
+		return err
+	}
+	if dstFile.existOnInit {
+		if control := opts.backupControl(); control != "" {
+			if err := backupFile(dstFile, control, opts); err != nil {
+				return err
+			}
+		}
+	}
+
+	dir, err := openParent(dst, opts)
+	if err != nil {
+		return err
+	}
+	defer dir.close()
+	if err := opts.Journal.record(dst, true, opts); err != nil {
+		return err
+	}
+	opts.logInfo("preserving hard link, linking dst to first copy", "dst", dst, "first", first)
+	name := filepath.Base(dst)
+	if !dstFile.existOnInit {
+		if err := dir.link(first, name); err != nil {
+			return &Error{Op: "link", Src: first, Dst: dst, Kind: ErrCannotOpenOrCreateDstFile, Err: err}
+		}
+		opts.Hooks.onLink(first, dst)
+		return syncParent(dst, opts)
+	}
+	tmp, err := dir.makeTemp(name, func(tmp string) error {
+		return dir.link(first, tmp)
+	})
+	if err != nil {
+		return &Error{Op: "link", Src: first, Dst: dst, Kind: ErrCannotOpenOrCreateDstFile, Err: err}
+	}
+	if err := dir.rename(tmp, name); err != nil {
+		_ = dir.remove(tmp)
+		return &Error{Op: "rename", Src: filepath.Join(dir.path, tmp), Dst: dst, Kind: ErrCannotRenameTempFile, Err: err}
+	}
+	opts.Hooks.onLink(first, dst)
+	return syncParent(dst, opts)
+}
@@ -0,0 +1,150 @@
+package flop
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Hooks are called as Copy changes the file system, so a client can audit or react to each change, like
+// invalidating a cache.  Every hook is optional.  A Before hook can veto an operation by returning an error,
+// which stops the copy and is returned by Copy unchanged.  Hooks are called from the goroutine running Copy.
+type Hooks struct {
+	// BeforeCopy is called before each entry is created at dst from src, once dst has been checked and is not
+	// skipped: before the content of a regular file or object is copied, and before a hard link, symbolic link
+	// or special file is created.  Directories are not vetoed.
+	BeforeCopy func(src, dst string) error
+	// AfterCopy is called after the content of src is copied to dst, with the number of bytes written.
+	AfterCopy func(src, dst string, bytes int64)
+	// OnMkdir is called for each directory created.
+	OnMkdir func(dir string)
+	// OnBackup is called after a backup of file is made at backup.
+	OnBackup func(file, backup string)
+	// OnLink is called after dst is created as a hard link to src, with Options.Link or
+	// Options.PreserveHardLinks.
+	OnLink func(src, dst string)
+	// OnSymlink is called after dst is created as a copy of the symbolic link src, which points to target.
+	OnSymlink func(src, dst, target string)
+	// OnSpecial is called after dst is created as a copy of the named pipe, device node or socket src.
+	OnSpecial func(src, dst string)
+	// OnDelete is called after Sync removes dst.
+	OnDelete func(dst string)
+	// OnSkip is called when src is not copied to dst, with the reason why.
+	OnSkip func(src, dst, reason string)
+	// OnChmod is called after the permissions of dst are changed to mode.
+	OnChmod func(dst string, mode os.FileMode)
+}
+
+// beforeCopy calls BeforeCopy if it is set.
+func (h Hooks) beforeCopy(src, dst string) error {
+	if h.BeforeCopy == nil {
+		return nil
+	}
+	return h.BeforeCopy(src, dst)
+}
+
+// afterCopy calls AfterCopy if it is set.
+func (h Hooks) afterCopy(src, dst string, bytes int64) {
+	if h.AfterCopy != nil {
+		h.AfterCopy(src, dst, bytes)
+	}
+}
+
+// onMkdir calls OnMkdir if it is set.
+func (h Hooks) onMkdir(dir string) {
+	if h.OnMkdir != nil {
+		h.OnMkdir(dir)
+	}
+}
+
+// onBackup calls OnBackup if it is set.
+func (h Hooks) onBackup(file, backup string) {
+	if h.OnBackup != nil {
+		h.OnBackup(file, backup)
+	}
+}
+
+// onLink calls OnLink if it is set.
+func (h Hooks) onLink(src, dst string) {
+	if h.OnLink != nil {
+		h.OnLink(src, dst)
+	}
+}
+
+// onSymlink calls OnSymlink if it is set.
+func (h Hooks) onSymlink(src, dst, target string) {
+	if h.OnSymlink != nil {
+		h.OnSymlink(src, dst, target)
+	}
+}
+
+// onSpecial calls OnSpecial if it is set.
+func (h Hooks) onSpecial(src, dst string) {
+	if h.OnSpecial != nil {
+		h.OnSpecial(src, dst)
+	}
+}
+
+// onDelete calls OnDelete if it is set.
+func (h Hooks) onDelete(dst string) {
+	if h.OnDelete != nil {
+		h.OnDelete(dst)
+	}
+}
+
+// onSkip calls OnSkip if it is set.
+func (h Hooks) onSkip(src, dst, reason string) {
+	if h.OnSkip != nil {
+		h.OnSkip(src, dst, reason)
+	}
+}
+
+// onChmod calls OnChmod if it is set.
+func (h Hooks) onChmod(dst string, mode os.FileMode) {
+	if h.OnChmod != nil {
+		h.OnChmod(dst, mode)
+	}
+}
+
+// rebase returns Hooks which call h with destination paths under from moved under to, so hooks called while
+// copying into a staging directory report where the files end up.
+func (h Hooks) rebase(from, to string) Hooks {
+	move := func(path string) string {
+		if rel, err := filepath.Rel(from, path); err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return filepath.Join(to, rel)
+		}
+		return path
+	}
+	rebased := Hooks{}
+	if h.BeforeCopy != nil {
+		rebased.BeforeCopy = func(src, dst string) error { return h.BeforeCopy(src, move(dst)) }
+	}
+	if h.AfterCopy != nil {
+		rebased.AfterCopy = func(src, dst string, bytes int64) { h.AfterCopy(src, move(dst), bytes) }
+	}
+	if h.OnMkdir != nil {
+		rebased.OnMkdir = func(dir string) { h.OnMkdir(move(dir)) }
+	}
+	if h.OnBackup != nil {
+		rebased.OnBackup = func(file, backup string) { h.OnBackup(move(file), move(backup)) }
+	}
+	if h.OnLink != nil {
+		rebased.OnLink = func(src, dst string) { h.OnLink(src, move(dst)) }
+	}
+	if h.OnSymlink != nil {
+		rebased.OnSymlink = func(src, dst, target string) { h.OnSymlink(src, move(dst), target) }
+	}
+	if h.OnSpecial != nil {
+		rebased.OnSpecial = func(src, dst string) { h.OnSpecial(src, move(dst)) }
+	}
+	if h.OnDelete != nil {
+		rebased.OnDelete = func(dst string) { h.OnDelete(move(dst)) }
+	}
+	if h.OnSkip != nil {
+		rebased.OnSkip = func(src, dst, reason string) { h.OnSkip(src, move(dst), reason) }
+	}
+	if h.OnChmod != nil {
+		rebased.OnChmod = func(dst string, mode os.FileMode) { h.OnChmod(move(dst), mode) }
+	}
+	return rebased
+}
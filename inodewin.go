@@ -0,0 +1,25 @@
+// +build windows
+
+package flop
+
+import (
+	"os"
+)
+
+// linkedInode on Windows systems always returns false.  File indexes are not available from os.FileInfo, so
+// hard links are not preserved.
+func linkedInode(info os.FileInfo) (inode, bool) {
+	return inode{}, false
+}
+
+// fileDevice on Windows systems always returns false.  Volume serial numbers are not available from
+// os.FileInfo, so every directory is treated as being on the same file system.
+func fileDevice(info os.FileInfo) (uint64, bool) {
+	return 0, false
+}
+
+// fileOwner on Windows systems always returns false.  Owners are security descriptors which are not available
+// from os.FileInfo, so owners are never compared.
+func fileOwner(info os.FileInfo) (uid, gid uint32, ok bool) {
+	return 0, 0, false
+}
@@ -0,0 +1,186 @@
+package flop
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Journal records every destination changed by Copy and CopyMany so the changes can be undone.  Set
+// Options.Journal to journal a copy, then call Rollback to restore the previous state, or Commit to keep the
+// changes and discard the saved content.  A Journal may be shared by several calls, like each step of a
+// deploy.  Local files and directories written by a download are journaled, object store destinations are not.
+type Journal struct {
+	mu      sync.Mutex
+	entries []journalEntry
+	// recorded tracks paths already in the journal, only the first change to a path needs to be undone
+	recorded map[string]bool
+}
+
+// journalEntry is a single change to the filesystem.
+type journalEntry struct {
+	// path is the destination that was changed.
+	path string
+	// saved holds the prior content of path, empty if path did not exist before.
+	saved string
+	// dir is true for a directory created by the copy.  It is only removed if it is empty.
+	dir bool
+	// tree is true for a directory tree swapped into place by AtomicTree.
+	tree bool
+}
+
+// NewJournal creates a new, empty Journal.
+func NewJournal() *Journal {
+	return &Journal{recorded: map[string]bool{}}
+}
+
+// add appends an entry unless its path is already journaled.  j.mu must be held.
+func (j *Journal) add(e journalEntry) bool {
+	if j.recorded == nil {
+		j.recorded = map[string]bool{}
+	}
+	if j.recorded[e.path] {
+		return false
+	}
+	j.recorded[e.path] = true
+	j.entries = append(j.entries, e)
+	return true
+}
+
+// record saves the current state of path before it is overwritten or removed.  An existing file is saved with
+// a hard link when link is true, which is only safe when path will be replaced rather than written to, and
+// copied otherwise.  A file written to through a symbolic link changes the target of the link, so the target
+// is saved instead.  Recording is a noop on a nil Journal.
+func (j *Journal) record(path string, link bool, opts Options) error {
+	if j == nil {
+		return nil
+	}
+	if !link {
+		if target, err := filepath.EvalSymlinks(path); err == nil {
+			path = target
+		}
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.recorded[path] {
+		return nil
+	}
+
+	if _, err := os.Lstat(path); os.IsNotExist(err) {
+		j.add(journalEntry{path: path})
+		return nil
+	}
+
+	var saved string
+	var err error
+	if link {
+		saved, err = linkTemp(path, path)
+	}
+	if !link || err != nil {
+		saved = unusedTemp(path)
+		err = Copy(path, saved, Options{Logger: opts.Logger})
+	}
+	if err != nil {
+		return err
+	}
+	opts.logDebug("journal saved file", "path", path, "saved", saved)
+	j.add(journalEntry{path: path, saved: saved})
+	return nil
+}
+
+// recordTree records a directory tree swapped into place by AtomicTree.  saved holds the replaced tree, or is
+// empty if there was none.
+func (j *Journal) recordTree(path, saved string) {
+	if j == nil {
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.add(journalEntry{path: path, saved: saved, tree: true})
+}
+
+// recordDirs records directories created by the copy, from the top down.
+func (j *Journal) recordDirs(dirs []string) {
+	if j == nil {
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	for _, dir := range dirs {
+		j.add(journalEntry{path: dir, dir: true})
+	}
+}
+
+// isSaved returns true if path holds content the Journal saved to undo a change, which must be kept until
+// Rollback or Commit.  It is false on a nil Journal.
+func (j *Journal) isSaved(path string) bool {
+	if j == nil {
+		return false
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	path = filepath.Clean(path)
+	for _, e := range j.entries {
+		if e.saved != "" && filepath.Clean(e.saved) == path {
+			return true
+		}
+	}
+	return false
+}
+
+// Rollback undoes every journaled change, newest first, restoring the saved content of overwritten files and
+// removing files and directories that were created.  Every change is attempted and the first error is
+// returned, including saved content that has gone missing and so cannot be restored.  The Journal is empty
+// afterwards.
+func (j *Journal) Rollback() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	var firstErr error
+	keep := func(err error) {
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	// a created file which is already gone is as good as removed
+	removed := func(err error) {
+		if !os.IsNotExist(err) {
+			keep(err)
+		}
+	}
+	for i := len(j.entries) - 1; i >= 0; i-- {
+		e := j.entries[i]
+		switch {
+		case e.tree && e.saved != "":
+			keep(exchange(e.saved, e.path, Options{Logger: funcLogger{}}))
+			removed(os.RemoveAll(e.saved))
+		case e.tree:
+			removed(os.RemoveAll(e.path))
+		case e.saved != "":
+			keep(rename(e.saved, e.path))
+		default:
+			removed(os.Remove(e.path))
+		}
+	}
+	j.entries, j.recorded = nil, nil
+	return firstErr
+}
+
+// Commit keeps every journaled change and removes the saved content.  Every saved file is removed and the
+// first error is returned.  The Journal is empty afterwards.
+func (j *Journal) Commit() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	var firstErr error
+	for _, e := range j.entries {
+		if e.saved == "" {
+			continue
+		}
+		if err := os.RemoveAll(e.saved); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	j.entries, j.recorded = nil, nil
+	return firstErr
+}
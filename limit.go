@@ -0,0 +1,82 @@
+package flop
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// clockNow and clockSleep are the clock used by Limiter.  They are variables so tests can use a fake clock.
+var (
+	clockNow   = time.Now
+	clockSleep = time.Sleep
+)
+
+// Limiter limits the rate bytes are copied.  A single Limiter may be shared by concurrent calls to Copy, so
+// their combined rate stays under the limit.  See Options.Limiter.
+type Limiter struct {
+	mu sync.Mutex
+	// bytesPerSecond is the rate limit.
+	bytesPerSecond int64
+	// next is when the bytes already copied are paid for, and the next read may go ahead.
+	next time.Time
+}
+
+// NewLimiter creates a Limiter allowing bytesPerSecond bytes to be copied per second.  A Limiter with a
+// bytesPerSecond of zero or less does not limit.
+func NewLimiter(bytesPerSecond int64) *Limiter {
+	return &Limiter{bytesPerSecond: bytesPerSecond}
+}
+
+// wait blocks until the bytes copied so far are paid for, then charges n more bytes.  Unused time is not
+// saved up, so an idle Limiter does not allow a burst.
+func (l *Limiter) wait(n int) {
+	if l.bytesPerSecond <= 0 {
+		return
+	}
+	l.mu.Lock()
+	now := clockNow()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	delay := l.next.Sub(now)
+	l.next = l.next.Add(time.Duration(int64(n) * int64(time.Second) / l.bytesPerSecond))
+	l.mu.Unlock()
+	if delay > 0 {
+		clockSleep(delay)
+	}
+}
+
+// limitedReader is an io.Reader which waits on a Limiter for every read.
+type limitedReader struct {
+	r       io.Reader
+	limiter *Limiter
+}
+
+// Read reads from the underlying reader, then waits for the bytes read to be allowed.
+func (l *limitedReader) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	if n > 0 {
+		l.limiter.wait(n)
+	}
+	return n, err
+}
+
+// limiter returns the Limiter to use, or nil if copies are not rate limited.
+func (o *Options) limiter() *Limiter {
+	if o.Limiter != nil {
+		return o.Limiter
+	}
+	if o.BytesPerSecond > 0 {
+		return NewLimiter(o.BytesPerSecond)
+	}
+	return nil
+}
+
+// throttle returns r limited by Options.Limiter, or r itself if copies are not rate limited.
+func (o *Options) throttle(r io.Reader) io.Reader {
+	if o.Limiter == nil {
+		return r
+	}
+	return &limitedReader{r: r, limiter: o.Limiter}
+}
@@ -0,0 +1,90 @@
+package flop
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// Logger receives leveled, structured log messages from Copy.  keyvals alternate between string keys and
+// their values, like "src", "/a", "bytes", int64(3).  Common keys are src, dst, tmp, backup, bytes and
+// elapsed.
+type Logger interface {
+	// Debug logs details of how a file is copied.
+	Debug(msg string, keyvals ...interface{})
+	// Info logs each file copied.
+	Info(msg string, keyvals ...interface{})
+}
+
+// funcLogger is a Logger that formats messages for Options.InfoLogFunc and Options.DebugLogFunc.
+type funcLogger struct {
+	info, debug func(string)
+}
+
+func (f funcLogger) Debug(msg string, keyvals ...interface{}) {
+	if f.debug != nil {
+		f.debug(formatLog(msg, keyvals))
+	}
+}
+
+func (f funcLogger) Info(msg string, keyvals ...interface{}) {
+	if f.info != nil {
+		f.info(formatLog(msg, keyvals))
+	}
+}
+
+// formatLog appends each key and value in keyvals to msg as key=value.  Values containing spaces are quoted.
+func formatLog(msg string, keyvals []interface{}) string {
+	var b strings.Builder
+	b.WriteString(msg)
+	for i := 0; i < len(keyvals); i += 2 {
+		var value interface{} = "MISSING"
+		if i+1 < len(keyvals) {
+			value = keyvals[i+1]
+		}
+		v := fmt.Sprint(value)
+		if strings.ContainsAny(v, " \t\n\"") {
+			v = fmt.Sprintf("%q", v)
+		}
+		fmt.Fprintf(&b, " %v=%s", keyvals[i], v)
+	}
+	return b.String()
+}
+
+// zerologLogger is a Logger writing to a zerolog.Logger.
+type zerologLogger struct {
+	l zerolog.Logger
+}
+
+// NewZerologLogger creates a Logger writing to l, with each key and value as a field of the event.
+func NewZerologLogger(l zerolog.Logger) Logger {
+	return zerologLogger{l: l}
+}
+
+func (z zerologLogger) Debug(msg string, keyvals ...interface{}) {
+	zerologFields(z.l.Debug(), keyvals).Msg(msg)
+}
+
+func (z zerologLogger) Info(msg string, keyvals ...interface{}) {
+	zerologFields(z.l.Info(), keyvals).Msg(msg)
+}
+
+// zerologFields adds each key and value in keyvals to e.
+func zerologFields(e *zerolog.Event, keyvals []interface{}) *zerolog.Event {
+	for i := 0; i+1 < len(keyvals); i += 2 {
+		key := fmt.Sprint(keyvals[i])
+		switch v := keyvals[i+1].(type) {
+		case time.Duration:
+			e = e.Dur(key, v)
+		case error:
+			e = e.AnErr(key, v)
+		case fmt.Stringer:
+			e = e.Str(key, v.String())
+		default:
+			e = e.Interface(key, v)
+		}
+	}
+	return e
+}
@@ -0,0 +1,412 @@
+package flop
+
+import (
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// objectURLScheme prefixes paths which refer to an object store instead of the local filesystem.
+const objectURLScheme = "s3://"
+
+// multipartPartSize is the size of each part uploaded when Options.Atomic is used with an object store.
+// S3 requires all parts except the last to be at least 5 MiB.
+const multipartPartSize = 8 << 20
+
+// ObjectStore is an S3-compatible bucket that can be used as the src or dst of Copy.  Paths in the form
+// s3://bucket/prefix are resolved against Options.ObjectStores using the bucket name.  Directories map
+// to key prefixes separated by '/'.
+type ObjectStore interface {
+	// PutObject writes size bytes from r to key.  If ifNoneMatch is true and key already exists the
+	// object is left untouched and ErrObjectExists is returned.
+	PutObject(key string, r io.Reader, size int64, ifNoneMatch bool) error
+	// GetObject opens key for reading.  ErrFileNotExist is returned if key does not exist.
+	GetObject(key string) (io.ReadCloser, error)
+	// ListObjects returns every object whose key begins with prefix.
+	ListObjects(prefix string) ([]ObjectInfo, error)
+	// CreateMultipartUpload starts a multipart upload to key and returns its upload id.
+	CreateMultipartUpload(key string) (string, error)
+	// UploadPart uploads a single part of a multipart upload and returns its ETag.
+	UploadPart(key, uploadID string, partNumber int, r io.Reader, size int64) (string, error)
+	// CompleteMultipartUpload assembles the uploaded parts, making key visible in a single step.  If
+	// ifNoneMatch is true and key already exists ErrObjectExists is returned.
+	CompleteMultipartUpload(key, uploadID string, parts []CompletedPart, ifNoneMatch bool) error
+	// AbortMultipartUpload discards an upload and any parts uploaded so far.
+	AbortMultipartUpload(key, uploadID string) error
+}
+
+// ObjectInfo describes an object in an ObjectStore.
+type ObjectInfo struct {
+	// Key is the full key of the object.
+	Key string
+	// Size is the size of the object in bytes.
+	Size int64
+}
+
+// CompletedPart identifies an uploaded part of a multipart upload.
+type CompletedPart struct {
+	// PartNumber is the 1-based position of the part.
+	PartNumber int
+	// ETag is the value returned by ObjectStore.UploadPart.
+	ETag string
+}
+
+// isObjectURL returns true if path refers to an object store.
+func isObjectURL(path string) bool {
+	return strings.HasPrefix(path, objectURLScheme)
+}
+
+// objectStore resolves an s3://bucket/prefix url to the configured ObjectStore and the key prefix.
+func (o *Options) objectStore(url string) (ObjectStore, string, error) {
+	rest := strings.TrimPrefix(url, objectURLScheme)
+	bucket, key := rest, ""
+	if i := strings.Index(rest, "/"); i >= 0 {
+		bucket, key = rest[:i], rest[i+1:]
+	}
+	store, ok := o.ObjectStores[bucket]
+	if !ok || store == nil {
+		return nil, "", &Error{Op: "lookup", Dst: url, Kind: ErrUnknownBucket, Err: errors.Errorf("bucket '%s'", bucket)}
+	}
+	return store, key, nil
+}
+
+// copyObjects copies between the local filesystem and an object store.
+func copyObjects(src, dst string, opts Options) error {
+	switch {
+	case isObjectURL(src) && isObjectURL(dst):
+		return &Error{Op: "copy", Src: src, Dst: dst, Kind: ErrObjectToObject}
+	case isObjectURL(dst):
+		// objects cannot be restored, so uploads are not journaled
+		opts.Journal = nil
+		store, key, err := opts.objectStore(dst)
+		if err != nil {
+			return err
+		}
+		return upload(src, store, key, opts)
+	default:
+		store, key, err := opts.objectStore(src)
+		if err != nil {
+			return err
+		}
+		return download(store, strings.TrimSuffix(strings.TrimSuffix(src, key), "/")+"/", key, dst, opts)
+	}
+}
+
+// upload copies the local file or directory tree at src into store under prefix.
+func upload(src string, store ObjectStore, prefix string, opts Options) error {
+	srcFile := NewFile(src)
+	if err := srcFile.setInfo(); err != nil {
+		return &Error{Op: "stat", Src: srcFile.Path, Kind: ErrCannotStatFile, Err: err}
+	}
+	if !srcFile.existOnInit {
+		return &Error{Op: "stat", Src: srcFile.Path, Kind: ErrFileNotExist}
+	}
+
+	if !srcFile.isDir {
+		key := prefix
+		if key == "" || strings.HasSuffix(key, "/") {
+			key += filepath.Base(src)
+		}
+		return uploadFile(src, store, key, srcFile.fileInfoOnInit.Size(), opts)
+	}
+
+	if !opts.Recursive {
+		return &Error{Op: "upload", Src: srcFile.Path, Kind: ErrOmittingDir}
+	}
+	return filepath.Walk(src, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return &Error{Op: "readdir", Src: p, Kind: ErrReadingSrcDir, Err: err}
+		}
+		if !info.Mode().IsRegular() {
+			if !info.IsDir() {
+				opts.logDebug("skipping non-regular file, it cannot be stored as an object", "src", p)
+			}
+			return nil
+		}
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		return uploadFile(p, store, path.Join(prefix, filepath.ToSlash(rel)), info.Size(), opts)
+	})
+}
+
+// uploadFile copies a single local file to key.  NoClobber is enforced with a conditional write and Atomic
+// uses a multipart upload so the object only becomes visible once it is complete.
+func uploadFile(src string, store ObjectStore, key string, size int64, opts Options) (err error) {
+	srcFD, err := os.Open(src)
+	if err != nil {
+		return &Error{Op: "open", Src: src, Kind: ErrCannotOpenSrc, Err: err}
+	}
+	defer func() {
+		if closeErr := srcFD.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}()
+
+	if opts.Atomic {
+		err = multipartUpload(opts.throttle(srcFD), store, key, size, opts)
+	} else {
+		opts.logInfo("uploading src file to object", "src", src, "key", key)
+		err = store.PutObject(key, opts.throttle(srcFD), size, opts.NoClobber)
+	}
+	if opts.NoClobber && errors.Cause(err) == ErrObjectExists {
+		opts.logDebug("object exists, will not clobber", "key", key)
+		return nil
+	}
+	return err
+}
+
+// multipartUpload uploads r to key in parts and completes the upload, aborting it on any error.
+func multipartUpload(r io.Reader, store ObjectStore, key string, size int64, opts Options) (err error) {
+	uploadID, err := store.CreateMultipartUpload(key)
+	if err != nil {
+		return err
+	}
+	opts.logDebug("created multipart upload", "upload", uploadID, "key", key)
+	defer func() {
+		if err != nil {
+			if abortErr := store.AbortMultipartUpload(key, uploadID); abortErr != nil {
+				opts.logDebug("err aborting multipart upload", "upload", uploadID, "err", abortErr)
+			}
+		}
+	}()
+
+	var parts []CompletedPart
+	for n, remaining := 1, size; n == 1 || remaining > 0; n++ {
+		partSize := remaining
+		if partSize > multipartPartSize {
+			partSize = multipartPartSize
+		}
+		opts.logInfo("uploading part of object", "part", n, "key", key, "bytes", partSize)
+		etag, err := store.UploadPart(key, uploadID, n, io.LimitReader(r, partSize), partSize)
+		if err != nil {
+			return err
+		}
+		parts = append(parts, CompletedPart{PartNumber: n, ETag: etag})
+		remaining -= partSize
+	}
+
+	opts.logInfo("completing multipart upload of object", "key", key)
+	return store.CompleteMultipartUpload(key, uploadID, parts, opts.NoClobber)
+}
+
+// download copies the object at key, or every object below the key prefix, from store to dst.  bucketURL is
+// the s3://bucket/ url of store, used to name objects to Hooks.
+func download(store ObjectStore, bucketURL, key, dst string, opts Options) error {
+	objects, err := store.ListObjects(key)
+	if err != nil {
+		return err
+	}
+	for _, obj := range objects {
+		if obj.Key == key && key != "" {
+			dstFile := NewFile(dst)
+			_ = dstFile.setInfo()
+			if dstFile.isDir {
+				if !opts.AppendNameToPath {
+					return &Error{Op: "download", Src: key, Dst: dstFile.Path, Kind: ErrWritingFileToExistingDir}
+				}
+				name, err := objectRelPath(path.Base(key))
+				if err != nil {
+					return &Error{Op: "download", Src: key, Dst: dstFile.Path, Kind: ErrUnsafeObjectKey, Err: err}
+				}
+				dst = filepath.Join(dst, name)
+			}
+			return downloadFile(store, bucketURL+key, key, dst, opts)
+		}
+	}
+
+	// key is a prefix, treat it like a directory
+	if !opts.Recursive {
+		return &Error{Op: "download", Src: key, Dst: dst, Kind: ErrOmittingDir}
+	}
+	prefix := key
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	found := false
+	for _, obj := range objects {
+		if !strings.HasPrefix(obj.Key, prefix) {
+			continue
+		}
+		found = true
+		rel := strings.TrimPrefix(obj.Key, prefix)
+		if rel == "" || strings.HasSuffix(rel, "/") {
+			// directory placeholder objects carry no content
+			continue
+		}
+		localRel, err := objectRelPath(rel)
+		if err != nil {
+			return &Error{Op: "download", Src: obj.Key, Dst: dst, Kind: ErrUnsafeObjectKey, Err: err}
+		}
+		if err := downloadFile(store, bucketURL+obj.Key, obj.Key, filepath.Join(dst, localRel), opts); err != nil {
+			return err
+		}
+	}
+	if !found {
+		return &Error{Op: "download", Src: key, Kind: ErrFileNotExist}
+	}
+	return nil
+}
+
+// objectRelPath returns the object key rel, relative to the prefix being downloaded, as a local relative path.
+// Keys are chosen by whoever can write to the bucket, so a key which is absolute or has a ".." element, and
+// could be written outside of the destination, is an error.
+func objectRelPath(rel string) (string, error) {
+	local := filepath.FromSlash(rel)
+	if path.IsAbs(rel) || filepath.IsAbs(local) || filepath.VolumeName(local) != "" {
+		return "", errors.Errorf("key %q is absolute", rel)
+	}
+	for _, elem := range strings.FieldsFunc(rel, func(r rune) bool { return r == '/' || r == '\\' }) {
+		if elem == ".." {
+			return "", errors.Errorf("key %q has a .. element", rel)
+		}
+	}
+	clean := filepath.Clean(local)
+	if clean == "." || clean == ".." || strings.HasPrefix(clean, ".."+string(filepath.Separator)) {
+		return "", errors.Errorf("key %q does not name a file below the prefix", rel)
+	}
+	return clean, nil
+}
+
+// downloadFile copies a single object to the local file dst.  An existing dst is backed up like copyFile does,
+// once the object is downloaded when Options.Atomic is set.  src is the url of the object, passed to Hooks.
+func downloadFile(store ObjectStore, src, key, dst string, opts Options) (err error) {
+	dstFile := NewFile(dst)
+	_ = dstFile.setInfo()
+
+	if dstFile.existOnInit && opts.NoClobber {
+		opts.logDebug("dst exists, will not clobber", "dst", dstFile.Path)
+		opts.Hooks.onSkip(src, dstFile.Path, "no clobber")
+		return nil
+	}
+	if err := opts.Hooks.beforeCopy(src, dstFile.Path); err != nil {
+		return err
+	}
+
+	if err := mkdirAll(filepath.Dir(dstFile.Path), 0777, opts); err != nil {
+		return err
+	}
+
+	body, err := store.GetObject(key)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := body.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}()
+
+	dir, err := openDstDir(filepath.Dir(dstFile.Path), opts)
+	if err != nil {
+		switch {
+		case errors.Cause(err) == ErrPathEscapesRoot:
+			return err
+		case opts.Atomic:
+			return &Error{Op: "open", Dst: filepath.Dir(dstFile.Path), Kind: ErrCannotCreateTmpFile, Err: err}
+		default:
+			return &Error{Op: "open", Dst: filepath.Dir(dstFile.Path), Kind: ErrCannotOpenOrCreateDstFile, Err: err}
+		}
+	}
+	defer dir.close()
+
+	// new files are readable by everyone, existing files keep their permissions
+	const mode = 0644
+	if opts.Atomic {
+		tmpFD, err := dir.createTemp("copyfile-")
+		defer closeAndRemove(tmpFD, opts)
+		if err != nil {
+			return &Error{Op: "create", Dst: dir.path, Kind: ErrCannotCreateTmpFile, Err: err}
+		}
+
+		opts.logInfo("downloading object to tmp file", "key", key, "tmp", tmpFD.Name())
+		written, err := io.Copy(tmpFD, opts.throttle(body))
+		if err != nil {
+			return err
+		}
+		if err := tmpFD.Sync(); err != nil {
+			return err
+		}
+		if err := setPermissions(tmpFD, dstFile, mode, opts); err != nil {
+			return err
+		}
+		tmpInfo, err := tmpFD.Stat()
+		if err != nil {
+			return err
+		}
+		if err := tmpFD.Close(); err != nil {
+			return err
+		}
+
+		// back up dst only once the object is downloaded, undoing the backup if the rename fails
+		commitBackup, rollbackBackup, err := linkBackup(dstFile, opts.backupControl(), opts)
+		if err != nil {
+			return err
+		}
+		if err := opts.Journal.record(dstFile.Path, true, opts); err != nil {
+			rollbackBackup()
+			return err
+		}
+		if err := dir.verify(dstFile); err != nil {
+			rollbackBackup()
+			return err
+		}
+		opts.logInfo("renaming tmp file to dst", "tmp", tmpFD.Name(), "dst", dstFile.Path)
+		if err := rename(tmpFD.Name(), dstFile.Path); err != nil {
+			rollbackBackup()
+			return &Error{Op: "rename", Src: tmpFD.Name(), Dst: dstFile.Path, Kind: ErrCannotRenameTempFile, Err: err}
+		}
+		commitBackup()
+		if err := dir.verifyRenamed(filepath.Base(dstFile.Path), tmpInfo); err != nil {
+			return err
+		}
+		if err := syncParent(dstFile.Path, opts); err != nil {
+			return err
+		}
+		opts.Hooks.afterCopy(src, dstFile.Path, written)
+		return nil
+	}
+
+	if control := opts.backupControl(); control != "" && dstFile.existOnInit {
+		if err := backupFile(dstFile, control, opts); err != nil {
+			return err
+		}
+	}
+	if err := opts.Journal.record(dstFile.Path, false, opts); err != nil {
+		return err
+	}
+	dstFD, err := dir.create(dstFile)
+	if err != nil {
+		if cause := errors.Cause(err); cause == ErrFileChanged || cause == ErrPathEscapesRoot {
+			return err
+		}
+		return &Error{Op: "create", Dst: dstFile.Path, Kind: ErrCannotOpenOrCreateDstFile, Err: err}
+	}
+	defer func() {
+		if closeErr := dstFD.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}()
+
+	opts.logInfo("downloading object to dst file", "key", key, "dst", dstFile.Path)
+	written, err := io.Copy(dstFD, opts.throttle(body))
+	if err != nil {
+		return err
+	}
+	if err := dstFD.Sync(); err != nil {
+		return err
+	}
+	if err := syncParent(dstFile.Path, opts); err != nil {
+		return err
+	}
+	if err := setPermissions(dstFD, dstFile, mode, opts); err != nil {
+		return err
+	}
+	opts.Hooks.afterCopy(src, dstFile.Path, written)
+	return nil
+}
@@ -1,6 +1,8 @@
 package flop
 
-import "fmt"
+import (
+	"os"
+)
 
 // Options directly represent command line flags associated with GNU file operations.
 type Options struct {
@@ -9,15 +11,64 @@ type Options struct {
 	// by default it is an assumption better left to the client in a programmatic setting.
 	AppendNameToPath bool
 	// Atomic will copy contents to a temporary file in the destination's parent directory first, then
-	// rename the file to ensure the operation is atomic.
+	// rename the file to ensure the operation is atomic.  For object store destinations a multipart
+	// upload is used, and the object only becomes visible once the upload is completed.  When combined with
+	// Backup, the backup is hard linked into place after the new content is written and rolled back if the
+	// rename fails, so a destination is never left replaced without a backup or backed up without a replacement.
 	Atomic bool
-	// Backup makes a backup of each existing destination file. The backup suffix is '~'. Acceptable
-	// control values are:
-	//   - "off"       no backup will be made (default)
-	//   - "simple"    always make simple backups
-	//   - "numbered"  make numbered backups
-	//   - "existing"  numbered if numbered backups exist, simple otherwise
+	// AtomicTree will copy a directory tree into a staging directory next to the destination first, then swap
+	// it into place once every file is copied, so a failed recursive copy never leaves a partially populated
+	// destination.  The swap uses renameat2 with RENAME_EXCHANGE on Linux and renames the destination aside
+	// elsewhere.  An existing destination is hard linked into the staging directory, so the result is the same
+	// as a recursive copy into it.
+	AtomicTree bool
+	// Backup makes a backup of each existing destination file. The simple backup suffix is BackupSuffix.
+	// Acceptable control values, and the GNU aliases for them, are:
+	//   - "off", "none"      no backup will be made (default)
+	//   - "simple", "never"  always make simple backups
+	//   - "numbered", "t"    make numbered backups
+	//   - "timestamp"        make backups named with the time they were made, like file.~20060102T150405Z~,
+	//                        with a sequence number added for more backups in the same second, like
+	//                        file.~20060102T150405Z-1~
+	//   - "existing", "nil"  numbered if numbered backups exist, timestamped if timestamped backups exist,
+	//                        simple otherwise
+	//   - "env"              like cp -b, the control value from the VERSION_CONTROL environment variable
+	//                        when BackupEnv is set, "existing" otherwise
 	Backup string
+	// BackupTimeLayout is the time.Format layout used to name timestamped backups, in UTC.  Defaults to
+	// "20060102T150405Z".
+	BackupTimeLayout string
+	// BackupSuffix is appended to the file name of simple backups.  Defaults to '~'.
+	BackupSuffix string
+	// BackupDir places backups under this directory instead of next to the file being replaced.  The
+	// destination tree is mirrored, so backups keep their path relative to the destination given to Copy.
+	BackupDir string
+	// BackupRetain prunes numbered and timestamped backups that fall outside of the Retention after a successful copy
+	// that makes numbered or timestamped backups.  Existing backups are left alone when Backup is off or simple.
+	BackupRetain Retention
+	// BackupEnv will honor the environment variables used by cp.  When Backup is "env" the VERSION_CONTROL
+	// environment variable is used as the control value, and when BackupSuffix is empty the
+	// SIMPLE_BACKUP_SUFFIX environment variable is used.  It never turns on backups by itself.
+	BackupEnv bool
+	// BytesPerSecond, if greater than zero, limits the rate file contents are copied, across the whole copy of
+	// a directory tree.  Ignored when Limiter is set.
+	BytesPerSecond int64
+	// ConfineTo, if set, is a root directory every destination must lie beneath.  Destinations that would be
+	// reached through a symbolic link, including a link in any parent directory, are refused with
+	// ErrPathEscapesRoot rather than written through.  On Linux files are opened with openat2 using
+	// RESOLVE_BENEATH and RESOLVE_NO_SYMLINKS.  Backups must also lie beneath ConfineTo.
+	ConfineTo string
+	// CopySpecial will recreate named pipes, device nodes and sockets at the destination with mkfifo or mknod
+	// instead of returning ErrSpecialFile.  Their content is never read.  Special files found while copying a
+	// directory tree are skipped unless CopySpecial is set.  Creating device nodes usually requires root.
+	CopySpecial bool
+	// Durable will sync the parent directory of each destination after it is created or renamed into place,
+	// along with the parent of each directory created along the way, so the copy survives a power loss once
+	// Copy returns.  File contents are always synced.
+	Durable bool
+	// Limiter, if set, limits the rate file contents are copied.  Share one Limiter between concurrent copies
+	// to limit their combined rate.  See NewLimiter.
+	Limiter *Limiter
 	// Link creates hard links to files instead of copying them.
 	Link bool
 	// MkdirAll will use os.MkdirAll to create the destination directory if it does not exist, along with
@@ -25,20 +76,101 @@ type Options struct {
 	MkdirAll bool
 	// mkdirAll is an internal tracker for MkdirAll, including other validation checks
 	mkdirAll bool
-	// NoClobber will not let an existing file be overwritten.
+	// dstRoot is an internal tracker for the destination given to the top level call of Copy
+	dstRoot string
+	// NoClobber will not let an existing file be overwritten.  For object store destinations this is
+	// enforced with a conditional write.
 	NoClobber bool
+	// OnConflict will, if defined, be asked how to resolve each copy of a regular file, preserved hard link or
+	// special file to an existing destination file, like cp -i but programmatic.  src and dst describe the files as found before copying.
+	// Returning an error stops the copy, and the error is returned by Copy unchanged.  NoClobber takes
+	// precedence, and an existing destination is skipped without asking.
+	OnConflict func(src, dst os.FileInfo) (Decision, error)
+	// OneFileSystem will, when copying a directory tree, skip subdirectories on a different file system than
+	// the source directory, like cp -x.  Each skipped mount point is logged.  Mount points are not detected on
+	// Windows.
+	OneFileSystem bool
+	// srcDev is an internal tracker for OneFileSystem, the device of the source directory
+	srcDev *uint64
+	// ObjectStores maps bucket names to the ObjectStore used when src or dst is given as s3://bucket/prefix.
+	ObjectStores map[string]ObjectStore
 	// Parents will create source directories in dst if they do not already exist. ErrWithParentsDstMustBeDir
 	// is returned if destination is not a directory.
 	Parents bool
+	// PreserveHardLinks will, when copying a directory tree, recreate files that are hard links to the same
+	// source file as hard links to the first copy, like cp --preserve=links.  Hard links are not detected on
+	// Windows.
+	PreserveHardLinks bool
+	// hardLinks is an internal tracker for PreserveHardLinks, shared by every file in the tree
+	hardLinks *hardLinks
+	// RecordFiles will, with CopyWithResult, keep a FileRecord for each file copied, linked or skipped in
+	// Result.Files.
+	RecordFiles bool
 	// Recursive will recurse through sub directories if set true.
 	Recursive bool
-	// InfoLogFunc will, if defined, handle logging info messages.
+	// Resume will continue an interrupted copy of a large file instead of starting over.  An existing
+	// destination whose content is the start of the source, compared by SHA-256 checksum, is appended to.  With
+	// Atomic the temporary file is given a predictable name and is kept when the copy fails, along with a
+	// sidecar state file recording the source and how much of it was synced, so the next copy verifies what
+	// was written by checksum and continues from there.
+	Resume bool
+	// TargetDirectory is used by CopyMany to require the destination to be an existing directory, even when
+	// there is a single source.
+	TargetDirectory bool
+	// NoTargetDirectory is used by CopyMany to treat the destination as a normal file, even when it is an
+	// existing directory.  Only one source may be given.
+	NoTargetDirectory bool
+	// Journal, if set, records every destination changed by the copy so the changes can be rolled back.
+	// See Journal.
+	Journal *Journal
+	// Hooks are called as files are copied, directories made, backups made, links created, permissions changed
+	// and files skipped.  See Hooks.
+	Hooks Hooks
+	// Logger will, if defined, handle logging structured messages, with fields like src, dst and bytes.  It
+	// takes precedence over InfoLogFunc and DebugLogFunc.
+	Logger Logger
+	// InfoLogFunc will, if defined and Logger is not, handle logging info messages.  Fields are appended to
+	// the message as key=value.
 	InfoLogFunc func(string)
-	// DebugLogFunc will, if defined, handle logging debug messages.
+	// DebugLogFunc will, if defined and Logger is not, handle logging debug messages.  Fields are appended to
+	// the message as key=value.
 	DebugLogFunc func(string)
 }
 
-// setLoggers will configure logging functions, setting noop loggers if log funcs are undefined.
+// backupControl returns the backup control value to use, or an empty string if no backup should be made.
+func (o *Options) backupControl() string {
+	if o.Backup != "env" {
+		return o.Backup
+	}
+	if control := os.Getenv("VERSION_CONTROL"); control != "" && o.BackupEnv {
+		return control
+	}
+	return "existing"
+}
+
+// backupTimeLayout returns the layout used to name timestamped backups.
+func (o *Options) backupTimeLayout() string {
+	if o.BackupTimeLayout != "" {
+		return o.BackupTimeLayout
+	}
+	return defaultBackupTimeLayout
+}
+
+// backupSuffix returns the suffix to use for simple backups.
+func (o *Options) backupSuffix() string {
+	if o.BackupSuffix != "" {
+		return o.BackupSuffix
+	}
+	if o.BackupEnv {
+		if suffix := os.Getenv("SIMPLE_BACKUP_SUFFIX"); suffix != "" {
+			return suffix
+		}
+	}
+	return "~"
+}
+
+// setLoggers will configure logging functions, setting noop loggers if log funcs are undefined.  Without a
+// Logger, one is made from the log funcs.
 func (o *Options) setLoggers() {
 	if o.InfoLogFunc == nil {
 		o.InfoLogFunc = func(string) {}
@@ -46,14 +178,25 @@ func (o *Options) setLoggers() {
 	if o.DebugLogFunc == nil {
 		o.DebugLogFunc = func(string) {}
 	}
+	if o.Logger == nil {
+		o.Logger = funcLogger{info: o.InfoLogFunc, debug: o.DebugLogFunc}
+	}
+}
+
+// logger returns the Logger, falling back to the log funcs if setLoggers has not been called.
+func (o *Options) logger() Logger {
+	if o.Logger != nil {
+		return o.Logger
+	}
+	return funcLogger{info: o.InfoLogFunc, debug: o.DebugLogFunc}
 }
 
-// logDebug will log to the DebugLogFunc.
-func (o *Options) logDebug(format string, a ...interface{}) {
-	o.DebugLogFunc(fmt.Sprintf(format, a...))
+// logDebug will log msg and the alternating keys and values in keyvals at debug level.
+func (o *Options) logDebug(msg string, keyvals ...interface{}) {
+	o.logger().Debug(msg, keyvals...)
 }
 
-// logInfo will log to the InfoLogFunc.
-func (o *Options) logInfo(format string, a ...interface{}) {
-	o.InfoLogFunc(fmt.Sprintf(format, a...))
+// logInfo will log msg and the alternating keys and values in keyvals at info level.
+func (o *Options) logInfo(msg string, keyvals ...interface{}) {
+	o.logger().Info(msg, keyvals...)
 }
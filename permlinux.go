@@ -3,14 +3,14 @@
 package flop
 
 import (
-	"github.com/pkg/errors"
 	"os"
 )
 
-// setPermissions will set file level permissions on dst based on options and other criteria.
-func setPermissions(dstFile *File, srcMode os.FileMode, opts Options) error {
+// setPermissions will set file level permissions on dst based on options and other criteria.  The permissions
+// are read and changed through dstFD, the open destination, so the file chmodded is the file that was written.
+func setPermissions(dstFD *os.File, dstFile *File, srcMode os.FileMode, opts Options) error {
 	var mode os.FileMode
-	fi, err := os.Stat(dstFile.Path)
+	fi, err := dstFD.Stat()
 	if err != nil {
 		return err
 	}
@@ -18,27 +18,29 @@ func setPermissions(dstFile *File, srcMode os.FileMode, opts Options) error {
 
 	if dstFile.existOnInit {
 		if mode == dstFile.fileInfoOnInit.Mode() {
-			opts.logDebug("existing dst %s permissions %s are unchanged", dstFile.Path, mode)
+			opts.logDebug("existing dst permissions are unchanged", "dst", dstFile.Path, "mode", mode)
 			return nil
 		}
 
 		// make sure dst perms are set to their original value
-		opts.logDebug("changing dst %s permissions to %s", dstFile.Path, dstFile.fileInfoOnInit.Mode())
-		err := os.Chmod(dstFile.Path, dstFile.fileInfoOnInit.Mode())
+		opts.logDebug("changing dst permissions", "dst", dstFile.Path, "mode", dstFile.fileInfoOnInit.Mode())
+		err := dstFD.Chmod(dstFile.fileInfoOnInit.Mode())
 		if err != nil {
-			return errors.Wrapf(ErrCannotChmodFile, "destination file %s: %s", dstFile.Path, err)
+			return &Error{Op: "chmod", Dst: dstFile.Path, Kind: ErrCannotChmodFile, Err: err}
 		}
+		opts.Hooks.onChmod(dstFile.Path, dstFile.fileInfoOnInit.Mode())
 	} else {
 		if mode == srcMode {
-			opts.logDebug("dst %s permissions %s already match src perms", dstFile.Path, mode)
+			opts.logDebug("dst permissions already match src perms", "dst", dstFile.Path, "mode", mode)
 		}
 
 		// make sure dst perms are set to that of src
-		opts.logDebug("changing dst %s permissions to %s", dstFile.Path, srcMode)
-		err := os.Chmod(dstFile.Path, srcMode)
+		opts.logDebug("changing dst permissions", "dst", dstFile.Path, "mode", srcMode)
+		err := dstFD.Chmod(srcMode)
 		if err != nil {
-			return errors.Wrapf(ErrCannotChmodFile, "destination file %s: %s", dstFile.Path, err)
+			return &Error{Op: "chmod", Dst: dstFile.Path, Kind: ErrCannotChmodFile, Err: err}
 		}
+		opts.Hooks.onChmod(dstFile.Path, srcMode)
 	}
 	return nil
 }
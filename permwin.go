@@ -7,7 +7,7 @@ import (
 )
 
 // setPermissions on Windows systems is a noop.  This will need to be handled by the client.
-func setPermissions(dstFile *File, srcMode os.FileMode, opts Options) error {
-	opts.logDebug("permission handling is ignored on Windows, dst file %s will be unchanged", dstFile.Path)
+func setPermissions(dstFD *os.File, dstFile *File, srcMode os.FileMode, opts Options) error {
+	opts.logDebug("permission handling is ignored on Windows, dst file will be unchanged", "dst", dstFile.Path)
 	return nil
 }
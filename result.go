@@ -0,0 +1,127 @@
+package flop
+
+import (
+	"sync"
+	"time"
+)
+
+// Result summarizes what CopyWithResult changed.  Changes made to object stores are not counted.
+type Result struct {
+	// Copied is the number of files whose content was copied.
+	Copied int
+	// Linked is the number of hard links created, with Options.Link or Options.PreserveHardLinks.
+	Linked int
+	// Symlinked is the number of symbolic links copied.
+	Symlinked int
+	// Special is the number of named pipes, device nodes and sockets recreated, with Options.CopySpecial.
+	Special int
+	// Skipped is the number of files not copied, like existing files kept by Options.NoClobber.
+	Skipped int
+	// DirsCreated is the number of directories created.
+	DirsCreated int
+	// Bytes is the total number of bytes copied.
+	Bytes int64
+	// Elapsed is how long the copy took.
+	Elapsed time.Duration
+	// Backups are the paths of the backups created, in the order they were made.
+	Backups []string
+	// Files has a FileRecord for each file copied, linked, recreated or skipped, in order, when
+	// Options.RecordFiles is set.
+	Files []FileRecord
+}
+
+// FileRecord describes what CopyWithResult did with a single file.
+type FileRecord struct {
+	// Op is "copy", "link", "symlink", "special" or "skip".
+	Op string
+	// Src is the source file, or the file linked to.
+	Src string
+	// Dst is the destination file.
+	Dst string
+	// Bytes is the number of bytes copied.
+	Bytes int64
+	// Reason is why the file was skipped, like "no clobber".
+	Reason string
+}
+
+// CopyWithResult will copy src to dst like Copy, and return a Result summarizing the copy.  When an error is
+// returned the Result describes the changes made before the error.
+func CopyWithResult(src, dst string, opts Options) (Result, error) {
+	r := &resultRecorder{records: opts.RecordFiles}
+	opts.Hooks = r.hooks(opts.Hooks)
+	start := time.Now()
+	err := Copy(src, dst, opts)
+	r.result.Elapsed = time.Since(start)
+	return r.result, err
+}
+
+// resultRecorder builds a Result from the Hooks called by Copy.
+type resultRecorder struct {
+	mu      sync.Mutex
+	records bool
+	result  Result
+}
+
+// record adds a FileRecord if records are kept.
+func (r *resultRecorder) record(rec FileRecord) {
+	if r.records {
+		r.result.Files = append(r.result.Files, rec)
+	}
+}
+
+// hooks returns Hooks which update the Result, then call the matching hook in next.
+func (r *resultRecorder) hooks(next Hooks) Hooks {
+	return Hooks{
+		BeforeCopy: next.BeforeCopy,
+		AfterCopy: func(src, dst string, bytes int64) {
+			r.mu.Lock()
+			r.result.Copied++
+			r.result.Bytes += bytes
+			r.record(FileRecord{Op: "copy", Src: src, Dst: dst, Bytes: bytes})
+			r.mu.Unlock()
+			next.afterCopy(src, dst, bytes)
+		},
+		OnMkdir: func(dir string) {
+			r.mu.Lock()
+			r.result.DirsCreated++
+			r.mu.Unlock()
+			next.onMkdir(dir)
+		},
+		OnBackup: func(file, backup string) {
+			r.mu.Lock()
+			r.result.Backups = append(r.result.Backups, backup)
+			r.mu.Unlock()
+			next.onBackup(file, backup)
+		},
+		OnLink: func(src, dst string) {
+			r.mu.Lock()
+			r.result.Linked++
+			r.record(FileRecord{Op: "link", Src: src, Dst: dst})
+			r.mu.Unlock()
+			next.onLink(src, dst)
+		},
+		OnSymlink: func(src, dst, target string) {
+			r.mu.Lock()
+			r.result.Symlinked++
+			r.record(FileRecord{Op: "symlink", Src: src, Dst: dst})
+			r.mu.Unlock()
+			next.onSymlink(src, dst, target)
+		},
+		OnSpecial: func(src, dst string) {
+			r.mu.Lock()
+			r.result.Special++
+			r.record(FileRecord{Op: "special", Src: src, Dst: dst})
+			r.mu.Unlock()
+			next.onSpecial(src, dst)
+		},
+		OnDelete: next.OnDelete,
+		OnSkip: func(src, dst, reason string) {
+			r.mu.Lock()
+			r.result.Skipped++
+			r.record(FileRecord{Op: "skip", Src: src, Dst: dst, Reason: reason})
+			r.mu.Unlock()
+			next.onSkip(src, dst, reason)
+		},
+		OnChmod: next.OnChmod,
+	}
+}
@@ -0,0 +1,222 @@
+package flop
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// resumeCheckpoint is how many bytes a resumable Atomic copy writes between saving its state.  It is a
+// variable so tests can checkpoint more often.
+var resumeCheckpoint int64 = 16 << 20
+
+// resumeState is saved in a sidecar file next to the temporary file of a resumable Atomic copy.  Offset is
+// only advanced once the bytes before it are synced, so a crash never leaves the state ahead of the file.
+type resumeState struct {
+	Src     string    `json:"src"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+	Offset  int64     `json:"offset"`
+}
+
+// resumeTempName returns the name of the temporary file a resumable Atomic copy to dst is written to.  Unlike
+// other temporary files it is predictable, so a later copy can find it.
+func resumeTempName(dst string) string {
+	return "." + filepath.Base(dst) + ".flop-resume"
+}
+
+// resumeStateName returns the name of the sidecar file holding the resumeState for the temporary file tmp.
+func resumeStateName(tmp string) string {
+	return tmp + ".json"
+}
+
+// resumable is the temporary file of an Atomic copy with Options.Resume.  The file and its state are kept
+// when the copy fails, so the next copy of the same source continues where it stopped.
+type resumable struct {
+	dir   *dstDir
+	fd    *os.File
+	name  string
+	state resumeState
+}
+
+// openResumable opens the temporary file for copying srcFD to dstFile, creating it if needed.  If its saved
+// state is for the same source and the bytes written so far still match the source by checksum, both files
+// are positioned to continue from there, otherwise the temporary file is started over.
+func (d *dstDir) openResumable(srcFD *os.File, srcFile, dstFile *File) (*resumable, error) {
+	name := resumeTempName(dstFile.Path)
+	fd, err := d.open(name, os.O_RDWR|os.O_CREATE, 0600, false)
+	if err != nil {
+		return nil, err
+	}
+	r := &resumable{dir: d, fd: fd, name: name, state: resumeState{
+		Src:     srcFile.Path,
+		Size:    srcFile.fileInfoOnInit.Size(),
+		ModTime: srcFile.fileInfoOnInit.ModTime(),
+	}}
+
+	saved, err := r.load()
+	if err != nil {
+		d.opts.logDebug("cannot read resume state, starting over", "tmp", fd.Name(), "err", err)
+	} else if saved.Src == r.state.Src && saved.Size == r.state.Size && saved.ModTime.Equal(r.state.ModTime) {
+		same, err := samePrefix(srcFD, fd, saved.Offset)
+		if err != nil {
+			_ = fd.Close()
+			return nil, err
+		}
+		if same {
+			r.state.Offset = saved.Offset
+		} else {
+			d.opts.logDebug("tmp file does not match src, starting over", "tmp", fd.Name(), "src", srcFile.Path)
+		}
+	}
+
+	// anything past the saved offset may not have been synced
+	if err := fd.Truncate(r.state.Offset); err != nil {
+		_ = fd.Close()
+		return nil, err
+	}
+	if err := seek(r.state.Offset, fd, srcFD); err != nil {
+		_ = fd.Close()
+		return nil, err
+	}
+	d.opts.logDebug("opened resumable tmp file", "tmp", fd.Name(), "offset", r.state.Offset)
+	return r, r.save()
+}
+
+// load reads the saved resumeState.  A missing state is the same as a state with nothing written.
+func (r *resumable) load() (resumeState, error) {
+	var saved resumeState
+	fd, err := r.dir.open(resumeStateName(r.name), os.O_RDONLY, 0, false)
+	if os.IsNotExist(err) {
+		return saved, nil
+	}
+	if err != nil {
+		return saved, err
+	}
+	defer fd.Close()
+	b, err := ioutil.ReadAll(fd)
+	if err != nil {
+		return saved, err
+	}
+	return saved, json.Unmarshal(b, &saved)
+}
+
+// save writes the resumeState and syncs it.
+func (r *resumable) save() error {
+	b, err := json.Marshal(r.state)
+	if err != nil {
+		return err
+	}
+	fd, err := r.dir.open(resumeStateName(r.name), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600, false)
+	if err != nil {
+		return err
+	}
+	if _, err := fd.Write(b); err != nil {
+		_ = fd.Close()
+		return err
+	}
+	if err := fd.Sync(); err != nil {
+		_ = fd.Close()
+		return err
+	}
+	return fd.Close()
+}
+
+// copy copies the rest of src to the temporary file, syncing it and saving the state every
+// resumeCheckpoint bytes.  It returns the number of bytes copied.
+func (r *resumable) copy(src io.Reader) (int64, error) {
+	var written int64
+	for {
+		n, err := io.CopyN(r.fd, src, resumeCheckpoint)
+		written += n
+		if n > 0 {
+			if err := r.fd.Sync(); err != nil {
+				return written, err
+			}
+			r.state.Offset += n
+			if err := r.save(); err != nil {
+				return written, err
+			}
+		}
+		if err == io.EOF {
+			return written, nil
+		}
+		if err != nil {
+			return written, err
+		}
+	}
+}
+
+// finish removes the saved state once the temporary file has been renamed into place.
+func (r *resumable) finish() {
+	if err := r.dir.remove(resumeStateName(r.name)); err != nil {
+		r.dir.opts.logDebug("err removing resume state", "tmp", r.fd.Name(), "err", err)
+	}
+}
+
+// openPartial opens the existing destination dstFile to continue copying srcFD into it, when its content is
+// the start of the source by checksum.  Both files are positioned at the end of the destination.  A nil file
+// is returned when the destination cannot be resumed and must be copied over.
+func (d *dstDir) openPartial(srcFD *os.File, srcFile, dstFile *File) (*os.File, int64, error) {
+	size := dstFile.fileInfoOnInit.Size()
+	if !dstFile.fileInfoOnInit.Mode().IsRegular() || size == 0 || size > srcFile.fileInfoOnInit.Size() {
+		return nil, 0, nil
+	}
+	fd, err := d.openExisting(dstFile)
+	if err != nil {
+		return nil, 0, err
+	}
+	same, err := samePrefix(srcFD, fd, size)
+	if err == nil && same {
+		err = seek(size, fd, srcFD)
+	}
+	if err != nil || !same {
+		_ = fd.Close()
+		return nil, 0, err
+	}
+	return fd, size, nil
+}
+
+// samePrefix returns true if the first n bytes of a and b have the same SHA-256 checksum.
+func samePrefix(a, b io.ReaderAt, n int64) (bool, error) {
+	sum := func(r io.ReaderAt) ([]byte, error) {
+		h := sha256.New()
+		copied, err := io.Copy(h, io.NewSectionReader(r, 0, n))
+		if err == nil && copied < n {
+			err = io.ErrUnexpectedEOF
+		}
+		return h.Sum(nil), err
+	}
+	sumA, err := sum(a)
+	if err != nil {
+		return false, ignoreShort(err)
+	}
+	sumB, err := sum(b)
+	if err != nil {
+		return false, ignoreShort(err)
+	}
+	return bytes.Equal(sumA, sumB), nil
+}
+
+// ignoreShort returns nil if err is io.ErrUnexpectedEOF, from a file shorter than the prefix compared.
+func ignoreShort(err error) error {
+	if err == io.ErrUnexpectedEOF {
+		return nil
+	}
+	return err
+}
+
+// seek moves each file to offset.
+func seek(offset int64, files ...*os.File) error {
+	for _, f := range files {
+		if _, err := f.Seek(offset, io.SeekStart); err != nil {
+			return err
+		}
+	}
+	return nil
+}
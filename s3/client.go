@@ -0,0 +1,251 @@
+// Package s3 implements flop.ObjectStore for S3-compatible object storage using path-style requests
+// signed with AWS Signature Version 4.
+package s3
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/homedepot/flop"
+)
+
+// Client is an ObjectStore for a single bucket of an S3-compatible service.
+type Client struct {
+	// Endpoint is the base url of the service, like https://s3.us-east-1.amazonaws.com or http://localhost:9000.
+	Endpoint string
+	// Bucket is the name of the bucket objects are read from and written to.
+	Bucket string
+	// Region is used when signing requests.  Defaults to us-east-1.
+	Region string
+	// AccessKeyID and SecretAccessKey are the credentials used to sign requests.  Requests are sent
+	// unsigned if AccessKeyID is empty.
+	AccessKeyID     string
+	SecretAccessKey string
+	// SessionToken is sent with requests when using temporary credentials.
+	SessionToken string
+	// HTTPClient performs requests.  Defaults to http.DefaultClient.
+	HTTPClient *http.Client
+	// now returns the signing time, it may be replaced in tests.
+	now func() time.Time
+}
+
+// NewClient creates a new Client for bucket at endpoint.
+func NewClient(endpoint, bucket, accessKeyID, secretAccessKey string) *Client {
+	return &Client{
+		Endpoint:        endpoint,
+		Bucket:          bucket,
+		AccessKeyID:     accessKeyID,
+		SecretAccessKey: secretAccessKey,
+	}
+}
+
+// errorResponse is the error document returned by S3.
+type errorResponse struct {
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+// listBucketResult is the response to a ListObjectsV2 request.
+type listBucketResult struct {
+	Contents []struct {
+		Key  string `xml:"Key"`
+		Size int64  `xml:"Size"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+// initiateMultipartUploadResult is the response to a CreateMultipartUpload request.
+type initiateMultipartUploadResult struct {
+	UploadID string `xml:"UploadId"`
+}
+
+// completeMultipartUpload is the request body of a CompleteMultipartUpload request.
+type completeMultipartUpload struct {
+	XMLName xml.Name `xml:"CompleteMultipartUpload"`
+	Parts   []struct {
+		PartNumber int    `xml:"PartNumber"`
+		ETag       string `xml:"ETag"`
+	} `xml:"Part"`
+}
+
+// PutObject writes size bytes from r to key.
+func (c *Client) PutObject(key string, r io.Reader, size int64, ifNoneMatch bool) error {
+	header := http.Header{}
+	if ifNoneMatch {
+		header.Set("If-None-Match", "*")
+	}
+	resp, err := c.do(http.MethodPut, key, nil, header, r, size)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// GetObject opens key for reading.  The caller must close the returned body.
+func (c *Client) GetObject(key string) (io.ReadCloser, error) {
+	resp, err := c.do(http.MethodGet, key, nil, nil, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// ListObjects returns every object whose key begins with prefix, following continuation tokens.
+func (c *Client) ListObjects(prefix string) ([]flop.ObjectInfo, error) {
+	var objects []flop.ObjectInfo
+	query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+	for {
+		var result listBucketResult
+		if err := c.doXML(http.MethodGet, "", query, nil, nil, &result); err != nil {
+			return nil, err
+		}
+		for _, obj := range result.Contents {
+			objects = append(objects, flop.ObjectInfo{Key: obj.Key, Size: obj.Size})
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return objects, nil
+		}
+		query.Set("continuation-token", result.NextContinuationToken)
+	}
+}
+
+// CreateMultipartUpload starts a multipart upload to key.
+func (c *Client) CreateMultipartUpload(key string) (string, error) {
+	var result initiateMultipartUploadResult
+	if err := c.doXML(http.MethodPost, key, url.Values{"uploads": {""}}, nil, nil, &result); err != nil {
+		return "", err
+	}
+	return result.UploadID, nil
+}
+
+// UploadPart uploads a single part of a multipart upload.
+func (c *Client) UploadPart(key, uploadID string, partNumber int, r io.Reader, size int64) (string, error) {
+	query := url.Values{"partNumber": {strconv.Itoa(partNumber)}, "uploadId": {uploadID}}
+	resp, err := c.do(http.MethodPut, key, query, nil, r, size)
+	if err != nil {
+		return "", err
+	}
+	if err := resp.Body.Close(); err != nil {
+		return "", err
+	}
+	return resp.Header.Get("ETag"), nil
+}
+
+// CompleteMultipartUpload assembles the uploaded parts into key.
+func (c *Client) CompleteMultipartUpload(key, uploadID string, parts []flop.CompletedPart, ifNoneMatch bool) error {
+	var body completeMultipartUpload
+	for _, p := range parts {
+		body.Parts = append(body.Parts, struct {
+			PartNumber int    `xml:"PartNumber"`
+			ETag       string `xml:"ETag"`
+		}{p.PartNumber, p.ETag})
+	}
+	b, err := xml.Marshal(body)
+	if err != nil {
+		return err
+	}
+	header := http.Header{}
+	if ifNoneMatch {
+		header.Set("If-None-Match", "*")
+	}
+	// S3 may report a failure with a 200 status, so the body is always checked for an error document
+	return c.doXML(http.MethodPost, key, url.Values{"uploadId": {uploadID}}, header, b, nil)
+}
+
+// AbortMultipartUpload discards an upload and any uploaded parts.
+func (c *Client) AbortMultipartUpload(key, uploadID string) error {
+	resp, err := c.do(http.MethodDelete, key, url.Values{"uploadId": {uploadID}}, nil, nil, 0)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// doXML performs a request with an optional xml body and decodes the response into v if it is not nil.
+func (c *Client) doXML(method, key string, query url.Values, header http.Header, body []byte, v interface{}) error {
+	resp, err := c.do(method, key, query, header, bytes.NewReader(body), int64(len(body)))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	var errResp errorResponse
+	if xml.Unmarshal(b, &errResp) == nil && errResp.Code != "" {
+		return responseError(resp.StatusCode, errResp, key)
+	}
+	if v == nil {
+		return nil
+	}
+	return xml.Unmarshal(b, v)
+}
+
+// do signs and sends a request, returning an error for any non-2xx response.
+func (c *Client) do(method, key string, query url.Values, header http.Header, body io.Reader, size int64) (*http.Response, error) {
+	u, err := url.Parse(c.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + c.Bucket
+	if key != "" {
+		u.Path += "/" + key
+	}
+	u.RawPath = uriEncode(u.Path, false)
+	u.RawQuery = canonicalQuery(query)
+
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = size
+	if size == 0 {
+		req.Body = http.NoBody
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	c.sign(req)
+
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		defer resp.Body.Close()
+		var errResp errorResponse
+		b, _ := ioutil.ReadAll(resp.Body)
+		_ = xml.Unmarshal(b, &errResp)
+		return nil, responseError(resp.StatusCode, errResp, key)
+	}
+	return resp, nil
+}
+
+// responseError converts an S3 error response to an error, mapping well known failures to flop errors.
+func responseError(status int, errResp errorResponse, key string) error {
+	switch {
+	case status == http.StatusPreconditionFailed || errResp.Code == "PreconditionFailed":
+		return &flop.Error{Op: "request", Dst: key, Kind: flop.ErrObjectExists}
+	case status == http.StatusNotFound && errResp.Code != "NoSuchBucket":
+		return &flop.Error{Op: "request", Src: key, Kind: flop.ErrFileNotExist}
+	}
+	if errResp.Code == "" {
+		errResp.Code = http.StatusText(status)
+	}
+	return fmt.Errorf("s3 request for %s failed with status %d: %s %s", key, status, errResp.Code, errResp.Message)
+}
@@ -0,0 +1,149 @@
+package s3
+
+import (
+	stderrors "errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/homedepot/flop"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUploadAndDownloadTree(t *testing.T) {
+	tests := []struct {
+		name string
+		opts flop.Options
+	}{
+		{"put", flop.Options{Recursive: true}},
+		{"multipart", flop.Options{Recursive: true, Atomic: true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert := assert.New(t)
+			c, srv := newTestClient()
+			tt.opts.ObjectStores = map[string]flop.ObjectStore{"bucket": c}
+			src := tmpTree(t)
+
+			assert.Nil(flop.Copy(src, "s3://bucket/backup", tt.opts))
+			b, ok := srv.Object("bucket", "backup/sub/deeper/c.txt")
+			assert.True(ok)
+			assert.Equal([]byte("c"), b)
+			assert.Equal(0, srv.Uploads())
+
+			dst, err := ioutil.TempDir("", "")
+			assert.Nil(err)
+			assert.Nil(flop.Copy("s3://bucket/backup", dst, tt.opts))
+			for _, name := range []string{"a.txt", "sub/b.txt", "sub/deeper/c.txt"} {
+				b, err := ioutil.ReadFile(filepath.Join(dst, filepath.FromSlash(name)))
+				assert.Nil(err)
+				assert.Equal([]byte(strings.TrimSuffix(filepath.Base(name), ".txt")), b)
+			}
+		})
+	}
+}
+
+func TestUploadNoClobber(t *testing.T) {
+	for _, atomic := range []bool{false, true} {
+		assert := assert.New(t)
+		c, srv := newTestClient()
+		srv.PutObject("bucket", "file.txt", []byte("existing"))
+
+		src := filepath.Join(tmpTree(t), "a.txt")
+		assert.Nil(flop.Copy(src, "s3://bucket/file.txt", flop.Options{
+			NoClobber:    true,
+			Atomic:       atomic,
+			ObjectStores: map[string]flop.ObjectStore{"bucket": c},
+		}))
+		b, _ := srv.Object("bucket", "file.txt")
+		assert.Equal([]byte("existing"), b)
+		assert.Equal(0, srv.Uploads(), "failed multipart uploads should be aborted")
+	}
+}
+
+func TestDownloadSingleObject(t *testing.T) {
+	assert := assert.New(t)
+	c, srv := newTestClient()
+	srv.PutObject("bucket", "dir/file.txt", []byte("foo"))
+	opts := flop.Options{ObjectStores: map[string]flop.ObjectStore{"bucket": c}}
+
+	dst, err := ioutil.TempDir("", "")
+	assert.Nil(err)
+	err = flop.Copy("s3://bucket/dir/file.txt", dst, opts)
+	assert.Equal(flop.ErrWritingFileToExistingDir, errors.Cause(err))
+
+	opts.AppendNameToPath = true
+	assert.Nil(flop.Copy("s3://bucket/dir/file.txt", dst, opts))
+	b, err := ioutil.ReadFile(filepath.Join(dst, "file.txt"))
+	assert.Nil(err)
+	assert.Equal([]byte("foo"), b)
+}
+
+func TestDownloadErrors(t *testing.T) {
+	assert := assert.New(t)
+	c, srv := newTestClient()
+	srv.PutObject("bucket", "dir/file.txt", []byte("foo"))
+	opts := flop.Options{ObjectStores: map[string]flop.ObjectStore{"bucket": c}}
+
+	assert.Equal(flop.ErrOmittingDir, errors.Cause(flop.Copy("s3://bucket/dir", tmpDir(t), opts)))
+	assert.Equal(flop.ErrUnknownBucket, errors.Cause(flop.Copy("s3://other/dir", tmpDir(t), opts)))
+	opts.Recursive = true
+	assert.Equal(flop.ErrFileNotExist, errors.Cause(flop.Copy("s3://bucket/missing", tmpDir(t), opts)))
+	assert.Equal(flop.ErrObjectToObject, errors.Cause(flop.Copy("s3://bucket/dir", "s3://bucket/other", opts)))
+
+	_, err := c.GetObject("missing")
+	assert.Equal(flop.ErrFileNotExist, errors.Cause(err))
+	assert.True(stderrors.Is(err, flop.ErrFileNotExist))
+	var flopErr *flop.Error
+	assert.True(stderrors.As(flop.Copy("s3://bucket/missing", tmpDir(t), opts), &flopErr))
+}
+
+func TestDownloadRejectsHostileKeys(t *testing.T) {
+	for _, key := range []string{"p/../../zz-escaped.txt", "p/sub/../../../zz-escaped.txt", "p//etc/zz-escaped.txt", "p/..", "p/a/.."} {
+		assert := assert.New(t)
+		c, srv := newTestClient()
+		srv.PutObject("bucket", key, []byte("escaped"))
+		base := tmpDir(t)
+		dst := filepath.Join(base, "a", "b")
+		opts := flop.Options{Recursive: true, MkdirAll: true, ObjectStores: map[string]flop.ObjectStore{"bucket": c}}
+
+		err := flop.Copy("s3://bucket/p", dst, opts)
+		assert.Equal(flop.ErrUnsafeObjectKey, errors.Cause(err), key)
+		_, err = os.Stat(filepath.Join(base, "zz-escaped.txt"))
+		assert.True(os.IsNotExist(err), key)
+	}
+}
+
+func TestListObjectsPaginates(t *testing.T) {
+	assert := assert.New(t)
+	c, srv := newTestClient()
+	srv.MaxKeys = 2
+	for _, k := range []string{"p/1", "p/2", "p/3", "p/4", "p/5", "q/1"} {
+		srv.PutObject("bucket", k, []byte(k))
+	}
+	objects, err := c.ListObjects("p/")
+	assert.Nil(err)
+	assert.Len(objects, 5)
+	assert.Equal("p/5", objects[4].Key)
+	assert.Equal(int64(3), objects[4].Size)
+}
+
+func TestKeysAreEscaped(t *testing.T) {
+	assert := assert.New(t)
+	c, srv := newTestClient()
+	key := "dir with space/f+i=l&e?.txt"
+	assert.Nil(c.PutObject(key, strings.NewReader("foo"), 3, false))
+	b, ok := srv.Object("bucket", key)
+	assert.True(ok)
+	assert.Equal([]byte("foo"), b)
+}
+
+func TestUriEncode(t *testing.T) {
+	assert := assert.New(t)
+	assert.Equal("a/b%20c~d", uriEncode("a/b c~d", false))
+	assert.Equal("a%2Fb%3D", uriEncode("a/b=", true))
+	assert.Equal("a=1&b=&c=%2F", canonicalQuery(map[string][]string{"c": {"/"}, "a": {"1"}, "b": {""}}))
+}
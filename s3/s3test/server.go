@@ -0,0 +1,276 @@
+// Package s3test provides an in-process stand-in for an S3-compatible service, for testing code that
+// uses flop with an object store without any network access.
+package s3test
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Server is an http.Handler implementing the subset of the S3 API used by flop: PutObject, GetObject,
+// ListObjectsV2 and multipart uploads, using path-style bucket addressing.  Buckets are created on first use.
+type Server struct {
+	// MaxKeys limits the number of keys returned by each list request, to exercise pagination.
+	// Defaults to 1000.
+	MaxKeys int
+
+	mu      sync.Mutex
+	buckets map[string]map[string][]byte
+	uploads map[string]*upload
+	nextID  int
+}
+
+// upload tracks an in progress multipart upload.
+type upload struct {
+	bucket, key string
+	parts       map[int][]byte
+}
+
+// NewServer creates a new, empty Server.
+func NewServer() *Server {
+	return &Server{
+		buckets: map[string]map[string][]byte{},
+		uploads: map[string]*upload{},
+	}
+}
+
+// Client returns an http.Client which sends every request directly to the Server without opening a socket.
+func (s *Server) Client() *http.Client {
+	return &http.Client{Transport: roundTripper{s}}
+}
+
+// Object returns the content of key in bucket and whether it exists.
+func (s *Server) Object(bucket, key string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, ok := s.buckets[bucket][key]
+	return b, ok
+}
+
+// PutObject stores content at key in bucket.
+func (s *Server) PutObject(bucket, key string, content []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.bucket(bucket)[key] = content
+}
+
+// Uploads returns the number of multipart uploads which have been neither completed nor aborted.
+func (s *Server) Uploads() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.uploads)
+}
+
+// roundTripper serves requests with a Server.
+type roundTripper struct {
+	s *Server
+}
+
+func (rt roundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	rec := httptest.NewRecorder()
+	rt.s.ServeHTTP(rec, req)
+	resp := rec.Result()
+	resp.Request = req
+	return resp, nil
+}
+
+// bucket returns the objects in the named bucket, creating it if needed.  s.mu must be held.
+func (s *Server) bucket(name string) map[string][]byte {
+	b, ok := s.buckets[name]
+	if !ok {
+		b = map[string][]byte{}
+		s.buckets[name] = b
+	}
+	return b
+}
+
+// ServeHTTP implements http.Handler.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 ") {
+		writeError(w, http.StatusForbidden, "AccessDenied", "request is not signed")
+		return
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, "/")
+	bucketName, key := path, ""
+	if i := strings.Index(path, "/"); i >= 0 {
+		bucketName, key = path[:i], path[i+1:]
+	}
+	bucket := s.bucket(bucketName)
+	query := r.URL.Query()
+
+	switch {
+	case key == "" && r.Method == http.MethodGet:
+		s.list(w, bucket, query.Get("prefix"), query.Get("continuation-token"))
+	case r.Method == http.MethodPost && query["uploads"] != nil:
+		s.nextID++
+		id := strconv.Itoa(s.nextID)
+		s.uploads[id] = &upload{bucket: bucketName, key: key, parts: map[int][]byte{}}
+		writeXML(w, struct {
+			XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+			Bucket   string
+			Key      string
+			UploadID string `xml:"UploadId"`
+		}{Bucket: bucketName, Key: key, UploadID: id})
+	case r.Method == http.MethodPut && query.Get("uploadId") != "":
+		u, ok := s.uploads[query.Get("uploadId")]
+		if !ok {
+			writeError(w, http.StatusNotFound, "NoSuchUpload", "upload does not exist")
+			return
+		}
+		n, err := strconv.Atoi(query.Get("partNumber"))
+		if err != nil || n < 1 {
+			writeError(w, http.StatusBadRequest, "InvalidArgument", "invalid part number")
+			return
+		}
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "IncompleteBody", err.Error())
+			return
+		}
+		u.parts[n] = b
+		w.Header().Set("ETag", etag(b))
+	case r.Method == http.MethodPost && query.Get("uploadId") != "":
+		s.complete(w, r, bucket, key, query.Get("uploadId"))
+	case r.Method == http.MethodDelete && query.Get("uploadId") != "":
+		delete(s.uploads, query.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodPut:
+		if _, exists := bucket[key]; exists && r.Header.Get("If-None-Match") == "*" {
+			writeError(w, http.StatusPreconditionFailed, "PreconditionFailed", "object already exists")
+			return
+		}
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "IncompleteBody", err.Error())
+			return
+		}
+		bucket[key] = b
+		w.Header().Set("ETag", etag(b))
+	case r.Method == http.MethodGet:
+		b, ok := bucket[key]
+		if !ok {
+			writeError(w, http.StatusNotFound, "NoSuchKey", "the specified key does not exist")
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+		_, _ = w.Write(b)
+	default:
+		writeError(w, http.StatusNotImplemented, "NotImplemented", fmt.Sprintf("%s is not supported", r.Method))
+	}
+}
+
+// list writes a ListObjectsV2 response.  The continuation token is the last key of the previous page.
+func (s *Server) list(w http.ResponseWriter, bucket map[string][]byte, prefix, after string) {
+	var keys []string
+	for k := range bucket {
+		if strings.HasPrefix(k, prefix) && k > after {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	type content struct {
+		Key  string
+		Size int
+	}
+	result := struct {
+		XMLName               xml.Name `xml:"ListBucketResult"`
+		Prefix                string
+		Contents              []content
+		IsTruncated           bool
+		NextContinuationToken string `xml:",omitempty"`
+	}{Prefix: prefix}
+
+	maxKeys := s.MaxKeys
+	if maxKeys <= 0 {
+		maxKeys = 1000
+	}
+	if len(keys) > maxKeys {
+		keys = keys[:maxKeys]
+		result.IsTruncated = true
+		result.NextContinuationToken = keys[len(keys)-1]
+	}
+	for _, k := range keys {
+		result.Contents = append(result.Contents, content{Key: k, Size: len(bucket[k])})
+	}
+	writeXML(w, result)
+}
+
+// complete assembles the parts of a multipart upload named in the request body.
+func (s *Server) complete(w http.ResponseWriter, r *http.Request, bucket map[string][]byte, key, id string) {
+	u, ok := s.uploads[id]
+	if !ok {
+		writeError(w, http.StatusNotFound, "NoSuchUpload", "upload does not exist")
+		return
+	}
+	var req struct {
+		Parts []struct {
+			PartNumber int
+			ETag       string
+		} `xml:"Part"`
+	}
+	if err := xml.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "MalformedXML", err.Error())
+		return
+	}
+	if _, exists := bucket[key]; exists && r.Header.Get("If-None-Match") == "*" {
+		writeError(w, http.StatusPreconditionFailed, "PreconditionFailed", "object already exists")
+		return
+	}
+
+	var b []byte
+	for _, p := range req.Parts {
+		part, ok := u.parts[p.PartNumber]
+		if !ok || etag(part) != p.ETag {
+			writeError(w, http.StatusBadRequest, "InvalidPart", fmt.Sprintf("part %d is invalid", p.PartNumber))
+			return
+		}
+		b = append(b, part...)
+	}
+	bucket[key] = b
+	delete(s.uploads, id)
+	writeXML(w, struct {
+		XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+		Key     string
+		ETag    string
+	}{Key: key, ETag: etag(b)})
+}
+
+func etag(b []byte) string {
+	sum := md5.Sum(b)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+func writeXML(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/xml")
+	b, err := xml.Marshal(v)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "InternalError", err.Error())
+		return
+	}
+	_, _ = w.Write(b)
+}
+
+func writeError(w http.ResponseWriter, status int, code, msg string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	b, _ := xml.Marshal(struct {
+		XMLName xml.Name `xml:"Error"`
+		Code    string
+		Message string
+	}{Code: code, Message: msg})
+	_, _ = w.Write(b)
+}
@@ -0,0 +1,37 @@
+package s3
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/homedepot/flop/s3/s3test"
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestClient returns a Client wired to a new in-process stand-in server.
+func newTestClient() (*Client, *s3test.Server) {
+	srv := s3test.NewServer()
+	c := NewClient("http://s3.test", "bucket", "AKID", "SECRET")
+	c.HTTPClient = srv.Client()
+	return c, srv
+}
+
+// tmpTree creates a directory with a nested file layout and returns its path.
+func tmpTree(t *testing.T) string {
+	src, err := ioutil.TempDir("", "")
+	assert.Nil(t, err)
+	assert.Nil(t, os.MkdirAll(filepath.Join(src, "sub", "deeper"), 0777))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(src, "a.txt"), []byte("a"), 0644))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(src, "sub", "b.txt"), []byte("b"), 0644))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(src, "sub", "deeper", "c.txt"), []byte("c"), 0644))
+	return src
+}
+
+// tmpDir creates a new temporary directory and returns its path.
+func tmpDir(t *testing.T) string {
+	d, err := ioutil.TempDir("", "")
+	assert.Nil(t, err)
+	return d
+}
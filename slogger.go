@@ -0,0 +1,27 @@
+// +build go1.21
+
+package flop
+
+import (
+	"context"
+	"log/slog"
+)
+
+// slogLogger is a Logger writing to a slog.Logger.
+type slogLogger struct {
+	l *slog.Logger
+}
+
+// NewSlogLogger creates a Logger writing to l, with each key and value as an attribute of the record.  It is
+// only available when built with Go 1.21 or later.
+func NewSlogLogger(l *slog.Logger) Logger {
+	return slogLogger{l: l}
+}
+
+func (s slogLogger) Debug(msg string, keyvals ...interface{}) {
+	s.l.Log(context.Background(), slog.LevelDebug, msg, keyvals...)
+}
+
+func (s slogLogger) Info(msg string, keyvals ...interface{}) {
+	s.l.Log(context.Background(), slog.LevelInfo, msg, keyvals...)
+}
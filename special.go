@@ -0,0 +1,75 @@
+package flop
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// specialModes are the mode bits of files that have no content to copy, like named pipes and device nodes.
+const specialModes = os.ModeNamedPipe | os.ModeDevice | os.ModeCharDevice | os.ModeSocket
+
+// isSpecial returns true if the file is a named pipe, device node or socket.
+func (f *File) isSpecial() bool {
+	return f.fileInfoOnInit.Mode()&specialModes != 0
+}
+
+// copySpecial recreates the named pipe, device node or socket src at dst when Options.CopySpecial is set, and
+// returns ErrSpecialFile otherwise.  Opening src to copy its content could block forever or read a device.
+// An existing dst is handled like copyFile does, and is replaced with a rename so it is never missing.
+func copySpecial(srcFile, dstFile *File, opts Options) error {
+	if !opts.CopySpecial {
+		return &Error{Op: "copy", Src: srcFile.Path, Dst: dstFile.Path, Kind: ErrSpecialFile}
+	}
+	if dstFile.existOnInit && dstFile.isDir {
+		return &Error{Op: "copy", Src: srcFile.Path, Dst: dstFile.Path, Kind: ErrWritingFileToExistingDir}
+	}
+	var err error
+	if dstFile, opts, err = resolveConflict(srcFile.Path, srcFile.fileInfoOnInit, dstFile, opts); err != nil || dstFile == nil {
+		return err
+	}
+	if err := opts.Hooks.beforeCopy(srcFile.Path, dstFile.Path); err != nil {
+		return err
+	}
+	if dstFile.existOnInit {
+		if control := opts.backupControl(); control != "" {
+			if err := backupFile(dstFile, control, opts); err != nil {
+				return err
+			}
+		}
+	}
+	if dstFile.shouldMakeParents(opts) {
+		if err := mkdirAll(filepath.Dir(dstFile.Path), 0777, opts); err != nil {
+			return err
+		}
+	}
+	dir, err := openParent(dstFile.Path, opts)
+	if err != nil {
+		return err
+	}
+	defer dir.close()
+	if err := opts.Journal.record(dstFile.Path, true, opts); err != nil {
+		return err
+	}
+
+	opts.logInfo("recreating special file at dst", "src", srcFile.Path, "dst", dstFile.Path)
+	name := filepath.Base(dstFile.Path)
+	if !dstFile.existOnInit {
+		if err := dir.mknod(srcFile.fileInfoOnInit, name); err != nil {
+			return &Error{Op: "create", Src: srcFile.Path, Dst: dstFile.Path, Kind: ErrCannotOpenOrCreateDstFile, Err: err}
+		}
+		opts.Hooks.onSpecial(srcFile.Path, dstFile.Path)
+		return syncParent(dstFile.Path, opts)
+	}
+	tmp, err := dir.makeTemp(name, func(tmp string) error {
+		return dir.mknod(srcFile.fileInfoOnInit, tmp)
+	})
+	if err != nil {
+		return &Error{Op: "create", Src: srcFile.Path, Dst: dstFile.Path, Kind: ErrCannotCreateTmpFile, Err: err}
+	}
+	if err := dir.rename(tmp, name); err != nil {
+		_ = dir.remove(tmp)
+		return &Error{Op: "rename", Src: filepath.Join(dir.path, tmp), Dst: dstFile.Path, Kind: ErrCannotRenameTempFile, Err: err}
+	}
+	opts.Hooks.onSpecial(srcFile.Path, dstFile.Path)
+	return syncParent(dstFile.Path, opts)
+}
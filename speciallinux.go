@@ -0,0 +1,44 @@
+// +build linux darwin
+
+package flop
+
+import (
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// makeSpecial creates a named pipe, device node or socket at path with the type, permissions and device
+// number described by info.
+func makeSpecial(info os.FileInfo, path string) error {
+	mode, dev, err := specialNode(info)
+	if err != nil {
+		return &os.PathError{Op: "mknod", Path: path, Err: err}
+	}
+	if mode&unix.S_IFMT == unix.S_IFIFO {
+		return unix.Mkfifo(path, mode&^unix.S_IFMT)
+	}
+	return unix.Mknod(path, mode, dev)
+}
+
+// specialNode returns the mknod mode and device number that recreate the named pipe, device node or socket
+// described by info.
+func specialNode(info os.FileInfo) (uint32, int, error) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, syscall.EINVAL
+	}
+	perm := uint32(info.Mode().Perm())
+	mode := info.Mode()
+	switch {
+	case mode&os.ModeNamedPipe != 0:
+		return unix.S_IFIFO | perm, 0, nil
+	case mode&os.ModeSocket != 0:
+		return unix.S_IFSOCK | perm, 0, nil
+	case mode&os.ModeCharDevice != 0:
+		return unix.S_IFCHR | perm, int(st.Rdev), nil
+	default:
+		return unix.S_IFBLK | perm, int(st.Rdev), nil
+	}
+}
@@ -0,0 +1,14 @@
+// +build windows
+
+package flop
+
+import (
+	"os"
+	"syscall"
+)
+
+// makeSpecial on Windows systems always fails.  Named pipes, device nodes and sockets cannot be created as
+// files.
+func makeSpecial(info os.FileInfo, path string) error {
+	return &os.PathError{Op: "mknod", Path: path, Err: syscall.EWINDOWS}
+}
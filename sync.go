@@ -0,0 +1,354 @@
+package flop
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// SyncOptions determine how Sync mirrors a tree.
+type SyncOptions struct {
+	// Options are used to copy each new or changed file, and to create directories.  Recursive is implied.
+	// Options.NoClobber and Options.OnConflict can still keep a changed file from being updated.
+	Options
+	// Checksum will compare regular files by SHA-256 checksum instead of by size and modification time.
+	Checksum bool
+	// Delete will remove destination entries that are not present in the source.
+	Delete bool
+	// Exclude are patterns for entries which are neither copied nor deleted.  See Protect for the patterns.
+	Exclude []string
+	// Protect are patterns for destination entries which are never deleted.  A pattern is matched with
+	// path.Match against the slash separated path relative to the root of the tree, and against the base name
+	// of the entry, like "*.log" or "cache/index".  A protected or excluded directory is kept whole.
+	Protect []string
+	// DryRun will report what Sync would change without changing anything.
+	DryRun bool
+}
+
+// SyncReport lists what Sync changed, or would change with SyncOptions.DryRun.  Paths are slash separated
+// and relative to the destination, with "." for the destination itself.
+type SyncReport struct {
+	// Created are the entries copied that did not exist in the destination.
+	Created []string
+	// Updated are the entries copied over a changed destination entry.
+	Updated []string
+	// Deleted are the destination entries removed because they are not in the source.
+	Deleted []string
+	// Protected are the destination entries not in the source which were kept because of SyncOptions.Protect.
+	Protected []string
+	// Skipped are the changed entries which were not copied because Options.NoClobber or Options.OnConflict
+	// kept the destination.  When OnConflict chooses RenameNew the renamed copy is listed in Created.  A dry run cannot ask OnConflict, so entries it would keep are listed as Updated.
+	Skipped []string
+}
+
+// Sync mirrors the tree at src to dst, like rsync -rlt.  New and changed files are copied with Copy, and the
+// modification time of each copied file is set to that of its source so later syncs can detect changes by
+// size and modification time.  With SyncOptions.Delete destination entries missing from src are removed.
+// Removals are not recorded in Options.Journal.  Backups, content saved by Options.Journal and the partial
+// files of Options.Resume are never deleted, like rsync protects its backups.
+func Sync(src, dst string, opts SyncOptions) (SyncReport, error) {
+	opts.setLoggers()
+	var report SyncReport
+	if _, err := os.Lstat(src); err != nil {
+		if os.IsNotExist(err) {
+			return report, &Error{Op: "sync", Src: src, Dst: dst, Kind: ErrFileNotExist}
+		}
+		return report, &Error{Op: "stat", Src: src, Kind: ErrCannotStatFile, Err: err}
+	}
+
+	copyOpts := opts.Options
+	copyOpts.Recursive = false
+	copyOpts.AppendNameToPath, copyOpts.Parents, copyOpts.AtomicTree = false, false, false
+	copyOpts.dstRoot = dst
+	copyOpts.Limiter = copyOpts.limiter()
+	// the records tell syncEntry where each file was written, which OnConflict may have changed
+	copyOpts.RecordFiles = true
+	// written holds the backups made by this sync, which are not in src but must not be deleted
+	written := map[string]bool{}
+
+	err := filepath.Walk(src, func(srcPath string, srcInfo os.FileInfo, err error) error {
+		if err != nil {
+			return &Error{Op: "readdir", Src: srcPath, Kind: ErrReadingSrcDir, Err: err}
+		}
+		rel, err := filepath.Rel(src, srcPath)
+		if err != nil {
+			return err
+		}
+		if rel != "." && matchesAny(opts.Exclude, rel) {
+			opts.logDebug("excluded from sync", "src", srcPath)
+			return skipEntry(srcInfo)
+		}
+		if srcInfo.Mode()&specialModes != 0 && !opts.CopySpecial {
+			opts.logInfo("skipping special file", "src", srcPath)
+			return nil
+		}
+		return opts.syncEntry(srcPath, filepath.Join(dst, rel), filepath.ToSlash(rel), srcInfo, copyOpts, &report, written)
+	})
+	if err != nil || !opts.Delete {
+		return report, err
+	}
+
+	err = filepath.Walk(dst, func(dstPath string, dstInfo os.FileInfo, err error) error {
+		if os.IsNotExist(err) && opts.DryRun {
+			// the destination was never created
+			return nil
+		}
+		if err != nil {
+			return &Error{Op: "readdir", Dst: dstPath, Kind: ErrReadingSrcDir, Err: err}
+		}
+		rel, err := filepath.Rel(dst, dstPath)
+		if err != nil || rel == "." {
+			return err
+		}
+		if matchesAny(opts.Exclude, rel) {
+			return skipEntry(dstInfo)
+		}
+		if _, err := os.Lstat(filepath.Join(src, rel)); !os.IsNotExist(err) {
+			return nil
+		}
+		if opts.keep(src, dst, rel, written) {
+			opts.logDebug("keeping dst entry written by flop", "dst", dstPath)
+			// a directory holding kept entries is walked, only its other entries are deleted
+			return nil
+		}
+		if matchesAny(opts.Protect, rel) {
+			opts.logDebug("protected from deletion", "dst", dstPath)
+			report.Protected = append(report.Protected, filepath.ToSlash(rel))
+			return skipEntry(dstInfo)
+		}
+		report.Deleted = append(report.Deleted, filepath.ToSlash(rel))
+		if !opts.DryRun {
+			opts.logInfo("deleting dst entry not in src", "dst", dstPath)
+			if err := os.RemoveAll(dstPath); err != nil {
+				return &Error{Op: "remove", Dst: dstPath, Kind: ErrCannotDeleteDst, Err: err}
+			}
+			opts.Hooks.onDelete(dstPath)
+			if err := syncParent(dstPath, opts.Options); err != nil {
+				return err
+			}
+		}
+		return skipEntry(dstInfo)
+	})
+	return report, err
+}
+
+// syncEntry makes the destination dstPath match the source srcPath.  It is added to the report once it is
+// changed, or as skipped if the changed destination was kept.
+func (o *SyncOptions) syncEntry(srcPath, dstPath, rel string, srcInfo os.FileInfo, copyOpts Options, report *SyncReport, written map[string]bool) error {
+	dstInfo, err := os.Lstat(dstPath)
+	exists := err == nil
+	if err != nil && !os.IsNotExist(err) {
+		return &Error{Op: "stat", Dst: dstPath, Kind: ErrCannotStatFile, Err: err}
+	}
+
+	sameType := exists && fileType(srcInfo) == fileType(dstInfo)
+	if sameType {
+		changed, err := o.changed(srcPath, dstPath, srcInfo, dstInfo)
+		if err != nil || !changed {
+			return err
+		}
+	}
+	if exists && !sameType {
+		// an entry of another type is deleted to make way, but never the destination itself
+		if !o.Delete || rel == "." {
+			kind := ErrCannotOverwriteNonDir
+			if dstInfo.IsDir() {
+				kind = ErrWritingFileToExistingDir
+			}
+			return &Error{Op: "sync", Src: srcPath, Dst: dstPath, Kind: kind}
+		}
+		if !o.DryRun {
+			o.logInfo("deleting dst entry of a different type than src", "dst", dstPath)
+			if err := os.RemoveAll(dstPath); err != nil {
+				return &Error{Op: "remove", Dst: dstPath, Kind: ErrCannotDeleteDst, Err: err}
+			}
+			o.Hooks.onDelete(dstPath)
+		}
+	}
+
+	if sameType && o.NoClobber {
+		// checked here as well as by Copy, so a changed symbolic link is not removed below
+		o.logDebug("dst exists, will not clobber", "dst", dstPath)
+		report.Skipped = append(report.Skipped, rel)
+		if !o.DryRun {
+			o.Hooks.onSkip(srcPath, dstPath, "no clobber")
+		}
+		return nil
+	}
+	if o.DryRun {
+		report.changed(rel, exists)
+		return nil
+	}
+
+	if srcInfo.IsDir() {
+		if err := mkdirAll(dstPath, srcInfo.Mode().Perm(), copyOpts); err != nil {
+			return err
+		}
+		report.changed(rel, exists)
+		return nil
+	}
+	if srcInfo.Mode()&os.ModeSymlink != 0 && sameType {
+		// a changed symbolic link is recreated, Copy cannot replace one
+		if err := os.Remove(dstPath); err != nil {
+			return &Error{Op: "remove", Dst: dstPath, Kind: ErrCannotDeleteDst, Err: err}
+		}
+		o.Hooks.onDelete(dstPath)
+	}
+	result, err := CopyWithResult(srcPath, dstPath, copyOpts)
+	for _, bkp := range result.Backups {
+		written[filepath.Clean(bkp)] = true
+	}
+	if err != nil {
+		return err
+	}
+	if result.Skipped > 0 {
+		// kept by Options.OnConflict, or by Options.NoClobber for an entry swapped in since it was checked
+		report.Skipped = append(report.Skipped, rel)
+		return nil
+	}
+	if renamed := renamedCopy(result, dstPath); renamed != "" {
+		// OnConflict chose RenameNew, dstPath was kept and the source was copied next to it
+		written[renamed] = true
+		report.Skipped = append(report.Skipped, rel)
+		report.Created = append(report.Created, path.Join(path.Dir(rel), filepath.Base(renamed)))
+		dstPath = renamed
+	} else {
+		report.changed(rel, exists)
+	}
+	if result.Copied > 0 {
+		// keep the time of the source so the copy is seen as unchanged next time
+		return os.Chtimes(dstPath, srcInfo.ModTime(), srcInfo.ModTime())
+	}
+	return nil
+}
+
+// renamedCopy returns the path a single file copy was written to when it is not dstPath, or "" if it was
+// written to dstPath.
+func renamedCopy(result Result, dstPath string) string {
+	for _, rec := range result.Files {
+		if rec.Op != "skip" && filepath.Clean(rec.Dst) != filepath.Clean(dstPath) {
+			return filepath.Clean(rec.Dst)
+		}
+	}
+	return ""
+}
+
+// changed adds rel to Created, or to Updated if it existed.
+func (r *SyncReport) changed(rel string, exists bool) {
+	if exists {
+		r.Updated = append(r.Updated, rel)
+	} else {
+		r.Created = append(r.Created, rel)
+	}
+}
+
+// keep returns true if the destination entry at rel, which is not in src, was written by flop and must not be
+// deleted: a backup, content saved by Options.Journal, the partial file of a resumable copy of a source file,
+// or a directory holding one of these.
+func (o *SyncOptions) keep(src, dst, rel string, written map[string]bool) bool {
+	dstPath := filepath.Clean(filepath.Join(dst, rel))
+	if written[dstPath] || o.Journal.isSaved(dstPath) {
+		return true
+	}
+	for p := range written {
+		if strings.HasPrefix(p, dstPath+string(filepath.Separator)) {
+			return true
+		}
+	}
+
+	name := filepath.Base(rel)
+	if o.Resume {
+		target := strings.TrimSuffix(strings.TrimSuffix(name, ".json"), ".flop-resume")
+		if target != name && strings.HasPrefix(target, ".") {
+			if _, err := os.Lstat(filepath.Join(src, filepath.Dir(rel), target[1:])); err == nil {
+				return true
+			}
+		}
+	}
+
+	if o.backupControl() == "" {
+		return false
+	}
+	if o.BackupDir != "" {
+		absDst, err := filepath.Abs(dst)
+		if err != nil {
+			return false
+		}
+		absBkp, err := filepath.Abs(o.BackupDir)
+		if err != nil {
+			return false
+		}
+		bkpRel, err := filepath.Rel(absDst, absBkp)
+		if err != nil || bkpRel == "." || strings.HasPrefix(bkpRel, "..") {
+			return false
+		}
+		return rel == bkpRel || strings.HasPrefix(rel, bkpRel+string(filepath.Separator)) ||
+			strings.HasPrefix(bkpRel, rel+string(filepath.Separator))
+	}
+	return strings.HasSuffix(name, o.backupSuffix()) || backupFileVersion.MatchString(name)
+}
+
+// changed returns true if the destination entry, of the same type as the source, differs from it.
+func (o *SyncOptions) changed(srcPath, dstPath string, srcInfo, dstInfo os.FileInfo) (bool, error) {
+	switch {
+	case srcInfo.IsDir():
+		return false, nil
+	case srcInfo.Mode()&os.ModeSymlink != 0:
+		srcLink, err := os.Readlink(srcPath)
+		if err != nil {
+			return false, err
+		}
+		dstLink, err := os.Readlink(dstPath)
+		return srcLink != dstLink, err
+	case srcInfo.Size() != dstInfo.Size():
+		return true, nil
+	case o.Checksum:
+		same, err := sameContent(srcPath, dstPath, srcInfo.Size())
+		return !same, err
+	default:
+		return !srcInfo.ModTime().Equal(dstInfo.ModTime()), nil
+	}
+}
+
+// matchesAny returns true if the path rel, or its base name, matches any of patterns with path.Match.
+func matchesAny(patterns []string, rel string) bool {
+	rel = filepath.ToSlash(rel)
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, rel); ok {
+			return true
+		}
+		if ok, _ := path.Match(pattern, path.Base(rel)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// fileType returns the type bits of info's mode.
+func fileType(info os.FileInfo) os.FileMode {
+	return info.Mode() & os.ModeType
+}
+
+// skipEntry returns filepath.SkipDir for a directory, so a walk does not descend into it, and nil otherwise.
+func skipEntry(info os.FileInfo) error {
+	if info.IsDir() {
+		return filepath.SkipDir
+	}
+	return nil
+}
+
+// sameContent returns true if the files a and b, both size bytes long, have the same SHA-256 checksum.
+func sameContent(a, b string, size int64) (bool, error) {
+	fdA, err := os.Open(a)
+	if err != nil {
+		return false, err
+	}
+	defer fdA.Close()
+	fdB, err := os.Open(b)
+	if err != nil {
+		return false, err
+	}
+	defer fdB.Close()
+	return samePrefix(fdA, fdB, size)
+}
@@ -0,0 +1,20 @@
+// +build linux darwin
+
+package flop
+
+import (
+	"os"
+)
+
+// fsyncDir flushes the entries of the directory dir to stable storage.
+func fsyncDir(dir string) error {
+	fd, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	if err := fd.Sync(); err != nil {
+		_ = fd.Close()
+		return err
+	}
+	return fd.Close()
+}
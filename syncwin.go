@@ -0,0 +1,9 @@
+// +build windows
+
+package flop
+
+// fsyncDir on Windows systems is a noop.  Directories cannot be opened for syncing and NTFS journals its
+// metadata changes.
+func fsyncDir(dir string) error {
+	return nil
+}
@@ -0,0 +1,151 @@
+package flop
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// copyTreeAtomic copies the src directory into a staging directory next to dst and swaps it into place once
+// the whole tree is copied, so dst is never left partially populated.  An existing dst is hard linked into
+// the staging directory first, so the result is the same as a recursive copy into dst.  The staging
+// directory, and the replaced tree after a swap, are removed unless the swap is journaled.
+func copyTreeAtomic(srcFile, dstFile *File, opts Options) (err error) {
+	if !opts.Recursive {
+		return &Error{Op: "copy", Src: srcFile.Path, Dst: dstFile.Path, Kind: ErrOmittingDir}
+	}
+
+	dst := filepath.Clean(dstFile.Path)
+	parent := filepath.Dir(dst)
+	if opts.mkdirAll {
+		opts.logDebug("making all dirs", "dir", parent)
+		if err := mkdirAll(parent, 0777, opts); err != nil {
+			return err
+		}
+	}
+
+	if err := confineDir(parent, opts); err != nil {
+		return err
+	}
+	stage, err := ioutil.TempDir(parent, "."+filepath.Base(dst)+".flop-stage-")
+	if err != nil {
+		return &Error{Op: "create", Dst: parent, Kind: ErrCannotCreateTmpFile, Err: err}
+	}
+	opts.logDebug("created staging dir", "stage", stage)
+	keepStage := false
+	defer func() {
+		if keepStage {
+			return
+		}
+		if removeErr := os.RemoveAll(stage); removeErr != nil {
+			opts.logDebug("err removing staging dir", "stage", stage, "err", removeErr)
+		}
+	}()
+
+	stageOpts := opts
+	stageOpts.AtomicTree = false
+	stageOpts.mkdirAll = false
+	stageOpts.dstRoot = stage
+	// the staging dir is thrown away on failure, only the swap itself needs to be journaled
+	stageOpts.Journal = nil
+	stageOpts.Hooks = opts.Hooks.rebase(stage, dst)
+	mode := srcFile.fileInfoOnInit.Mode()
+	if dstFile.existOnInit {
+		// files linked from dst must be replaced rather than written to, or the live tree would change
+		stageOpts.Atomic = true
+		mode = dstFile.fileInfoOnInit.Mode()
+		opts.logDebug("linking existing dst into staging dir", "dst", dst, "stage", stage)
+		if err := linkTree(dst, stage, opts); err != nil {
+			return err
+		}
+	}
+	if err := os.Chmod(stage, mode.Perm()); err != nil {
+		return &Error{Op: "chmod", Dst: stage, Kind: ErrCannotChmodFile, Err: err}
+	}
+
+	if err := Copy(srcFile.Path, stage, stageOpts); err != nil {
+		return err
+	}
+
+	if !dstFile.existOnInit {
+		opts.logInfo("renaming staging dir to dst", "stage", stage, "dst", dst)
+		if err := rename(stage, dst); err != nil {
+			return &Error{Op: "rename", Src: stage, Dst: dst, Kind: ErrCannotRenameTempFile, Err: err}
+		}
+		opts.Journal.recordTree(dst, "")
+		return syncParent(dst, opts)
+	}
+
+	opts.logInfo("exchanging staging dir with dst", "stage", stage, "dst", dst)
+	if err := exchange(stage, dst, opts); err != nil {
+		return &Error{Op: "exchange", Src: stage, Dst: dst, Kind: ErrCannotRenameTempFile, Err: err}
+	}
+	if opts.Journal != nil {
+		// the replaced tree is now in the staging dir, keep it until the journal is committed
+		keepStage = true
+		opts.Journal.recordTree(dst, stage)
+	}
+	return syncParent(dst, opts)
+}
+
+// renameAside swaps the directory at stage into dst by renaming dst out of the way first.  The old dst is
+// left at stage.  It is used where an atomic exchange is not available, so there is a brief moment where
+// dst does not exist.
+func renameAside(stage, dst string) error {
+	aside := unusedTemp(dst)
+	if err := rename(dst, aside); err != nil {
+		return err
+	}
+	if err := rename(stage, dst); err != nil {
+		if restoreErr := rename(aside, dst); restoreErr != nil {
+			return fmt.Errorf("cannot restore %s from %s: %v: %w", dst, aside, restoreErr, err)
+		}
+		return err
+	}
+	return rename(aside, stage)
+}
+
+// linkTree recreates the directory tree at src in the existing directory dst, hard linking files and copying
+// symbolic links.  Files are copied when they cannot be linked.  With Options.Durable every directory in dst
+// is synced once it is populated.
+func linkTree(src, dst string, opts Options) error {
+	dirs := []string{dst}
+	err := filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return &Error{Op: "readdir", Src: path, Kind: ErrReadingSrcDir, Err: err}
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil || rel == "." {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+
+		switch {
+		case info.IsDir():
+			dirs = append(dirs, target)
+			return os.Mkdir(target, info.Mode().Perm())
+		case info.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		default:
+			if err := os.Link(path, target); err != nil {
+				opts.logDebug("cannot hard link, copying instead", "src", path, "err", err)
+				return Copy(path, target, Options{Logger: opts.Logger})
+			}
+			return nil
+		}
+	})
+	if err != nil {
+		return err
+	}
+	for _, dir := range dirs {
+		if err := durableSync(dir, opts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -9,6 +9,8 @@ import (
 	"path"
 	"path/filepath"
 	"strings"
+	"sync"
+	"time"
 )
 
 // memoizeTmpDir holds memoization info for the temporary directory
@@ -109,3 +111,132 @@ func infoLogger(msg string) {
 		log.Info().Msg(msg)
 	}
 }
+
+// snapshot returns the content of every file in the tree at root, keyed by slash separated relative path.
+// Directories are included with empty content.
+func snapshot(root string) map[string]string {
+	snap := map[string]string{}
+	_ = filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(root, p)
+		if info.IsDir() {
+			snap[filepath.ToSlash(rel)+"/"] = ""
+			return nil
+		}
+		b, _ := ioutil.ReadFile(p)
+		snap[filepath.ToSlash(rel)] = string(b)
+		return nil
+	})
+	return snap
+}
+
+// crashFS simulates a filesystem that only persists directory entries when the directory is synced, so a
+// copy can be checked for what a power loss would lose.  Install it with install, which swaps syncDir.
+type crashFS struct {
+	// durable holds the entries of each directory as of its last sync, newest last.  Directories are matched
+	// with os.SameFile as renames move them to new paths.
+	durable []durableDir
+	// failSync, if set, makes syncing any directory containing it fail.
+	failSync string
+}
+
+// durableDir is the state of a directory as of a sync.
+type durableDir struct {
+	info    os.FileInfo
+	entries map[string]os.FileInfo
+}
+
+// newCrashFS creates a crashFS where everything under root is already durable.
+func newCrashFS(root string) *crashFS {
+	c := &crashFS{}
+	_ = c.syncDir(filepath.Dir(root))
+	_ = filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err == nil && info.IsDir() {
+			_ = c.syncDir(p)
+		}
+		return nil
+	})
+	return c
+}
+
+// install replaces syncDir with c and returns a func restoring it.
+func (c *crashFS) install() func() {
+	syncDir = c.syncDir
+	return func() { syncDir = fsyncDir }
+}
+
+func (c *crashFS) syncDir(dir string) error {
+	if c.failSync != "" && strings.HasPrefix(c.failSync, dir) {
+		return fmt.Errorf("simulated sync failure")
+	}
+	info, err := os.Lstat(dir)
+	if err != nil {
+		return err
+	}
+	entries := map[string]os.FileInfo{}
+	infos, _ := ioutil.ReadDir(dir)
+	for _, entry := range infos {
+		entries[entry.Name()] = entry
+	}
+	c.durable = append(c.durable, durableDir{info: info, entries: entries})
+	return nil
+}
+
+// lost returns every path under root, relative to root, which would not survive a crash because the entry
+// is missing from, or is a different file than, its directory as of the last sync.
+func (c *crashFS) lost(root string) []string {
+	var lost []string
+	_ = filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil || p == root {
+			return err
+		}
+		var durable os.FileInfo
+		if dirInfo, err := os.Lstat(filepath.Dir(p)); err == nil {
+			for _, d := range c.durable {
+				if os.SameFile(d.info, dirInfo) {
+					durable = d.entries[filepath.Base(p)]
+				}
+			}
+		}
+		if durable == nil || !os.SameFile(durable, info) {
+			rel, _ := filepath.Rel(root, p)
+			lost = append(lost, filepath.ToSlash(rel))
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+		}
+		return nil
+	})
+	return lost
+}
+
+// fakeClock is a clock for Limiter which only moves forward when slept on.  Install it with install, which
+// swaps clockNow and clockSleep.
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+	// slept is the total time slept.
+	slept time.Duration
+}
+
+// install replaces the Limiter clock with c and returns a func restoring it.
+func (c *fakeClock) install() func() {
+	c.now = time.Unix(0, 0)
+	clockNow, clockSleep = c.Now, c.Sleep
+	return func() { clockNow, clockSleep = time.Now, time.Sleep }
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Sleep(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	c.slept += d
+}